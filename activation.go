@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// the first descriptor passed by systemd, see sd_listen_fds(3)
+const listenFdsStart = 3
+
+// inheritedFds are the listening descriptors of --fd or of systemd socket
+// activation, the address is not listened on then.
+func inheritedFds() ([]int, error) {
+	if len(*listenFd) > 0 {
+		return *listenFd, nil
+	}
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	// not to be picked up by --exec commands
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	fds := make([]int, n)
+	for i := range fds {
+		fds[i] = listenFdsStart + i
+	}
+	return fds, nil
+}
+
+// listenInherited accepts on the descriptor like on a listener of the
+// address, --udp and --quic expect a datagram socket.
+func listenInherited(fd int, tlsConfig *tls.Config) error {
+	f := os.NewFile(uintptr(fd), "fd "+strconv.Itoa(fd))
+	// the listeners work on a duplicate
+	defer f.Close()
+	if *udp || *quicMode {
+		l, err := net.FilePacketConn(f)
+		if err != nil {
+			return err
+		}
+		if *quicMode {
+			_, err = listenQuic(l, tlsConfig)
+			return err
+		}
+		udpListeners = append(udpListeners, l)
+		return nil
+	}
+	l, err := net.FileListener(f)
+	if err != nil {
+		return err
+	}
+	addListener(l, tlsConfig)
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// output files of --atomic being written, by name
+var (
+	partFiles      = make(map[string]*outputFile)
+	partFilesMutex sync.Mutex
+)
+
+// openPartFile opens the output of a single connection with --atomic as
+// <name>.part, or returns nil when another connection is writing the name.
+func openPartFile(fileName string) *outputFile {
+	partFilesMutex.Lock()
+	defer partFilesMutex.Unlock()
+
+	if _, ok := partFiles[fileName]; ok {
+		log("Output file %s is written by another connection\n", fileName)
+		return nil
+	}
+	file := &outputFile{name: fileName, part: true}
+	if err := file.open(); errors.Is(err, errFileExists) {
+		log("Skip the connection, %s\n", err.Error())
+		return nil
+	} else if err != nil {
+		partFilesMutex.Unlock()
+		exit(err)
+	}
+	partFiles[fileName] = file
+	return file
+}
+
+// finish closes the output of a connection with --atomic and renames it to
+// the final name, unless the connection failed. Then the .part file is kept.
+func (o *outputFile) finish(info *connInfo) {
+	partFilesMutex.Lock()
+	_, ok := partFiles[o.name]
+	delete(partFiles, o.name)
+	partFilesMutex.Unlock()
+	if !ok {
+		// closed by quit already
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	err := o.close()
+	if err == nil && info.Error == "" {
+		final := strings.TrimSuffix(o.path, ".part")
+		if err = os.Rename(o.path, final); err == nil {
+			o.path = final
+			updateLatestSymlink(final)
+			return
+		}
+	}
+	if err != nil {
+		log("Finish %s error: %s\n", o.path, err.Error())
+	}
+	log("Keep %s of the failed connection %s\n", o.path, info.addr)
+}
+
+// closeParts closes the files of connections unfinished at exit, leaving them
+// as .part.
+func closeParts() {
+	partFilesMutex.Lock()
+	defer partFilesMutex.Unlock()
+	for name, file := range partFiles {
+		file.mutex.Lock()
+		if err := file.close(); err != nil {
+			log("Close %s error: %s\n", file.path, err.Error())
+		}
+		file.mutex.Unlock()
+		delete(partFiles, name)
+	}
+}
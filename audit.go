@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	auditWriter *csv.Writer
+	auditMutex  sync.Mutex
+)
+
+func openAuditCsv(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	auditWriter = csv.NewWriter(file)
+	if stat.Size() == 0 {
+		auditWriter.Write([]string{"timestamp", "ip", "port", "id", "bytes", "lines", "duration", "output-file"})
+		auditWriter.Flush()
+	}
+	return auditWriter.Error()
+}
+
+// auditConn appends the row of a finished connection to --audit-csv.
+func auditConn(info *connInfo, file *outputFile) {
+	if auditWriter == nil {
+		return
+	}
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	auditWriter.Write([]string{
+		info.start.Format(time.RFC3339Nano),
+		info.Ip,
+		strconv.Itoa(info.Port),
+		strconv.FormatInt(info.Id, 10),
+		strconv.FormatInt(info.Bytes, 10),
+		strconv.FormatInt(info.Lines, 10),
+		strconv.FormatFloat(time.Since(info.start).Seconds(), 'f', 3, 64),
+		file.label(),
+	})
+	auditWriter.Flush()
+	if err := auditWriter.Error(); err != nil {
+		log("Write audit csv error: %s\n", err.Error())
+	}
+}
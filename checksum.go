@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	manifest      io.Writer = os.Stderr
+	manifestMutex sync.Mutex
+)
+
+// streamDigest hashes the data of a connection for --checksum.
+type streamDigest struct {
+	hash.Hash
+	size int64
+}
+
+func newStreamDigest() *streamDigest {
+	switch *checksum {
+	case "md5":
+		return &streamDigest{Hash: md5.New()}
+	case "crc32":
+		return &streamDigest{Hash: crc32.NewIEEE()}
+	}
+	return &streamDigest{Hash: sha256.New()}
+}
+
+func (d *streamDigest) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	return d.Hash.Write(p)
+}
+
+func openManifest(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	manifest = file
+	return nil
+}
+
+// writeManifest appends the line of a finished connection to --manifest:
+// output file, digest, bytes, sender and time.
+func writeManifest(info *connInfo, file *outputFile) {
+	if info.digest == nil {
+		return
+	}
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+	_, err := fmt.Fprintf(manifest, "%s  %s  %d  %s  %s\n", file.label(), hex.EncodeToString(info.digest.Sum(nil)),
+		info.digest.size, info.addr, info.start.Format(time.RFC3339))
+	if err != nil {
+		log("Write manifest error: %s\n", err.Error())
+	}
+}
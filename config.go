@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+)
+
+var (
+	// the output file template, replaced on reload of --config
+	fileTemplate   *template.Template
+	fileTemplateMu sync.RWMutex
+
+	// of the last --config read, the address and the file are taken from it
+	// unless given on the command line
+	config         map[string]interface{}
+	addrFromConfig bool
+	fileFromConfig bool
+
+	listenerMutex    sync.Mutex
+	addressListeners = make(map[string]io.Closer)
+	removedListeners = make(map[io.Closer]bool)
+)
+
+func currentFileTemplate() *template.Template {
+	fileTemplateMu.RLock()
+	defer fileTemplateMu.RUnlock()
+	return fileTemplate
+}
+
+// configPath finds --config in the arguments before they are parsed, the
+// options of the file go in front of the command line ones.
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if path, ok := strings.CutPrefix(arg, "--config="); ok {
+			return path
+		}
+		if arg == "--config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// readConfig reads the YAML file of long flag names without the dashes, and
+// address and file for the arguments.
+func readConfig(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	if err = yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for name := range values {
+		if name != "address" && name != "file" && (name == "config" || kingpin.CommandLine.GetFlag(name) == nil) {
+			return nil, fmt.Errorf("%s: unknown option %q", path, name)
+		}
+	}
+	return values, nil
+}
+
+// configArgs turns the options of the config into flags, a list for a flag
+// which can be repeated.
+func configArgs(values map[string]interface{}) ([]string, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var args []string
+	for _, name := range names {
+		if name == "address" || name == "file" {
+			continue
+		}
+		switch v := values[name].(type) {
+		case bool:
+			if v {
+				args = append(args, "--"+name)
+			} else {
+				args = append(args, "--no-"+name)
+			}
+		case []interface{}:
+			for _, item := range v {
+				args = append(args, fmt.Sprintf("--%s=%v", name, item))
+			}
+		case map[string]interface{}:
+			return nil, fmt.Errorf("invalid value of %q in the config", name)
+		case nil:
+		default:
+			args = append(args, fmt.Sprintf("--%s=%v", name, v))
+		}
+	}
+	return args, nil
+}
+
+// configValue renders the address or the file of the config, several
+// addresses are joined by commas.
+func configValue(values map[string]interface{}, name string) string {
+	switch v := values[name].(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// handleReload reads --config again on every SIGHUP.
+func handleReload(tlsConfig *tls.Config) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadConfig(tlsConfig)
+	}
+}
+
+// reloadConfig applies a changed output file template and listens on the
+// addresses of the config, connections in flight keep their output files.
+// Other options can only change with a restart.
+func reloadConfig(tlsConfig *tls.Config) {
+	values, err := readConfig(*configFile)
+	if err != nil {
+		warn("Reload config error: %s\n", err.Error())
+		return
+	}
+	for name, value := range values {
+		if name != "address" && name != "file" && fmt.Sprint(value) != fmt.Sprint(config[name]) {
+			warn("Warning: %s changed in %s, restart to apply it\n", name, *configFile)
+		}
+	}
+	for name := range config {
+		if _, ok := values[name]; !ok && name != "address" && name != "file" {
+			warn("Warning: %s changed in %s, restart to apply it\n", name, *configFile)
+		}
+	}
+	if fileFromConfig {
+		if err = reloadFileTemplate(configValue(values, "file")); err != nil {
+			warn("Reload config error: %s\n", err.Error())
+			return
+		}
+	}
+	if addrFromConfig {
+		reloadAddresses(configValue(values, "address"), tlsConfig)
+	}
+	config = values
+	log("Reloaded %s\n", *configFile)
+}
+
+func reloadFileTemplate(text string) error {
+	var t *template.Template
+	if text != "" {
+		if *execText != "" || *outputURL != "" || *kafkaTopic != "" || *natsSubject != "" {
+			return fmt.Errorf("file can not be used with --exec, --output-url, --kafka-brokers or --nats")
+		}
+		var err error
+		if t, err = checkTemplate("fileName", text); err != nil {
+			return err
+		}
+	}
+	if *strictSingleFile {
+		if err := checkSingleFile(t, text); err != nil {
+			return err
+		}
+	}
+	fileTemplateMu.Lock()
+	fileTemplate = t
+	fileTemplateMu.Unlock()
+	return nil
+}
+
+// reloadAddresses stops listening on the addresses no longer given and
+// starts on the new ones.
+func reloadAddresses(text string, tlsConfig *tls.Config) {
+	if text == "" {
+		warn("Warning: no address in %s, keep listening\n", *configFile)
+		return
+	}
+	addresses := make(map[string]bool)
+	for _, address := range strings.Split(text, ",") {
+		addresses[address] = true
+	}
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		return
+	}
+	// the new listeners are served before the old ones stop, so that main
+	// does not take it for a shutdown
+	for address := range addresses {
+		if _, ok := addressListeners[address]; ok {
+			continue
+		}
+		if err := listen(address, tlsConfig); err != nil {
+			warn("Listen on %s error: %s\n", address, err.Error())
+		}
+	}
+	startServing()
+	for address, l := range addressListeners {
+		if addresses[address] {
+			continue
+		}
+		log("Stop listening on %s\n", address)
+		removedListeners[l] = true
+		delete(addressListeners, address)
+		removeListener(l)
+		l.Close()
+		if *unixSocket && *udp {
+			os.Remove(address)
+		}
+	}
+}
+
+// listenerRemoved reports whether the listener was closed by a reload
+// instead of a shutdown.
+func listenerRemoved(l io.Closer) bool {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	return removedListeners[l]
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// events kept while no supervisor is reading, the oldest ones are dropped
+const controlQueueSize = 1024
+
+type controlSocket struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	events   [][]byte
+	listener net.Listener
+}
+
+var control *controlSocket
+
+func openControlSocket(path string) (*controlSocket, error) {
+	// remove a socket left behind by a previous run
+	if stat, err := os.Stat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	c := &controlSocket{listener: listener}
+	c.cond = sync.NewCond(&c.mutex)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			log("Control client connected\n")
+			go c.serve(conn)
+		}
+	}()
+	return c, nil
+}
+
+func (c *controlSocket) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		c.mutex.Lock()
+		for len(c.events) == 0 {
+			c.cond.Wait()
+		}
+		event := c.events[0]
+		c.events = c.events[1:]
+		c.mutex.Unlock()
+
+		if _, err := conn.Write(event); err != nil {
+			log("Control client disconnected: %s\n", err.Error())
+			// keep the event for the next supervisor
+			c.mutex.Lock()
+			if len(c.events) < controlQueueSize {
+				c.events = append([][]byte{event}, c.events...)
+				c.cond.Signal()
+			}
+			c.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// complete queues the line "<output file>\t<bytes>" of a finished connection.
+func (c *controlSocket) complete(info *connInfo, file *outputFile) {
+	if c == nil {
+		return
+	}
+	event := []byte(file.label() + "\t" + strconv.FormatInt(info.Bytes, 10) + "\n")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.events) == controlQueueSize {
+		log("Control queue is full, drop the oldest event\n")
+		c.events = c.events[1:]
+	}
+	c.events = append(c.events, event)
+	c.cond.Signal()
+}
+
+func (c *controlSocket) Close() {
+	if c == nil {
+		return
+	}
+	// closing the listener unlinks the socket file
+	c.listener.Close()
+}
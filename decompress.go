@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+)
+
+var (
+	// the compression method byte is always deflate
+	gzipMagic  = []byte{0x1f, 0x8b, 0x08}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// decompressReader wraps the reader with the decoder of --compress. In auto
+// mode the format is told by peeking at the header, data matching none of
+// them is read as is. --gzip without --compress only detects gzip, as plain
+// text may well start like zlib or bzip2.
+func decompressReader(reader io.Reader) (io.Reader, error) {
+	format := *compress
+	peekReader := bufio.NewReader(reader)
+	if format == "none" && *gz {
+		if header, _ := peekReader.Peek(len(gzipMagic)); bytes.Equal(header, gzipMagic) {
+			format = "gzip"
+		}
+	} else if format == "auto" {
+		// the header of gzip with a file name is longer than peeked at
+		header, _ := peekReader.Peek(10)
+		format = "none"
+		if bytes.HasPrefix(header, gzipMagic) {
+			format = "gzip"
+		} else if bytes.HasPrefix(header, zstdMagic) {
+			format = "zstd"
+		} else if bytes.HasPrefix(header, xzMagic) {
+			format = "xz"
+		} else if len(header) >= 4 && bytes.HasPrefix(header, bzip2Magic) && header[3] >= '1' && header[3] <= '9' {
+			format = "bzip2"
+		} else if _, err := zlib.NewReader(bytes.NewReader(header)); err == nil {
+			format = "zlib"
+		}
+	}
+	switch format {
+	case "gzip":
+		return gzip.NewReader(peekReader)
+	case "zstd":
+		decoder, err := zstd.NewReader(peekReader, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &zstdReader{decoder}, nil
+	case "zlib":
+		return zlib.NewReader(peekReader)
+	case "deflate":
+		return flate.NewReader(peekReader), nil
+	case "bzip2":
+		return bzip2.NewReader(peekReader), nil
+	case "xz":
+		return xz.NewReader(peekReader)
+	}
+	return peekReader, nil
+}
+
+// zstdReader releases the decoder once the stream ended.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (r *zstdReader) Read(p []byte) (int, error) {
+	n, err := r.Decoder.Read(p)
+	if err != nil {
+		r.Decoder.Close()
+	}
+	return n, err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"os"
+	"sync"
+)
+
+// shared by all output files, as they usually land on the same disk
+var diskLimiter *rate.Limiter
+
+func newDiskLimiter(bytesPerSec int) *rate.Limiter {
+	burst := bytesPerSec
+	if burst > 64*1024 {
+		burst = 64 * 1024
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// diskThrottle decouples the writers of an output file from the disk: data
+// is queued in a buffer of at most max bytes and drained at --disk-rate, or
+// as fast as the disk takes it with --async-writes. Writers block once the
+// buffer is full, which in turn slows down reading from the network.
+type diskThrottle struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	max     int
+	write   func([]byte) (int, error)
+	err     error
+	// closing makes drain return once pending is written, it closes done then
+	closing bool
+	done    chan struct{}
+}
+
+func newDiskThrottle(write func([]byte) (int, error), max int) *diskThrottle {
+	t := &diskThrottle{
+		max:   max,
+		write: write,
+		done:  make(chan struct{}),
+	}
+	t.cond = sync.NewCond(&t.mutex)
+	go t.drain()
+	return t
+}
+
+func (t *diskThrottle) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for len(t.pending) > 0 && len(t.pending)+len(p) > t.max && t.err == nil {
+		t.cond.Wait()
+	}
+	if t.err != nil {
+		return 0, t.err
+	}
+	t.pending = append(t.pending, p...)
+	t.cond.Broadcast()
+	return len(p), nil
+}
+
+func (t *diskThrottle) drain() {
+	// what was queued meanwhile is written at once
+	size := int(*asyncWriteSize)
+	if diskLimiter != nil {
+		size = diskLimiter.Burst()
+	}
+	chunk := make([]byte, size)
+	for {
+		t.mutex.Lock()
+		for len(t.pending) == 0 && !t.closing {
+			t.cond.Wait()
+		}
+		if len(t.pending) == 0 {
+			if t.err == nil {
+				t.err = os.ErrClosed
+			}
+			t.cond.Broadcast()
+			t.mutex.Unlock()
+			close(t.done)
+			return
+		}
+		n := copy(chunk, t.pending)
+		t.mutex.Unlock()
+
+		if diskLimiter != nil {
+			diskLimiter.WaitN(context.Background(), n)
+		}
+		_, err := t.write(chunk[:n])
+
+		t.mutex.Lock()
+		t.pending = append(t.pending[:0], t.pending[n:]...)
+		if err != nil {
+			t.err = err
+		}
+		t.cond.Broadcast()
+		t.mutex.Unlock()
+	}
+}
+
+// Flush waits until all queued data has been written.
+func (t *diskThrottle) Flush() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for len(t.pending) > 0 && t.err == nil {
+		t.cond.Wait()
+	}
+	return t.err
+}
+
+// Close writes what is still queued and stops draining, further writes fail.
+func (t *diskThrottle) Close() error {
+	t.mutex.Lock()
+	t.closing = true
+	t.cond.Broadcast()
+	t.mutex.Unlock()
+	<-t.done
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.err == os.ErrClosed {
+		return nil
+	}
+	return t.err
+}
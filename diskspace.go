@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errDiskFull = errors.New("less than --min-free-space left on the disk")
+
+// diskGuard tells whether the file system of a directory has less than
+// --min-free-space left. It is nil without the flag.
+type diskGuard struct {
+	min   uint64
+	mutex sync.Mutex
+	dirs  map[string]*dirSpace
+}
+
+type dirSpace struct {
+	checked time.Time
+	low     bool
+}
+
+var diskSpace *diskGuard
+
+func newDiskGuard(min uint64) (*diskGuard, error) {
+	if _, err := freeSpace("."); err != nil {
+		return nil, err
+	}
+	return &diskGuard{min: min, dirs: make(map[string]*dirSpace)}, nil
+}
+
+// low checks a directory at most once a second, a directory not created yet
+// is on the file system of its closest parent.
+func (g *diskGuard) low(dir string) bool {
+	if g == nil {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	d := g.dirs[dir]
+	if d == nil {
+		d = &dirSpace{}
+		g.dirs[dir] = d
+	}
+	if time.Since(d.checked) < time.Second {
+		return d.low
+	}
+	d.checked = time.Now()
+	path := dir
+	free, err := freeSpace(path)
+	for err != nil && filepath.Dir(path) != path {
+		path = filepath.Dir(path)
+		free, err = freeSpace(path)
+	}
+	if err != nil {
+		return d.low
+	}
+	if low := free < g.min; low != d.low {
+		if low {
+			warn("Warning: %d bytes left for %s, %s from now on\n", free, dir, *diskFullPolicy)
+		} else {
+			warn("%d bytes left for %s again, write as usual\n", free, dir)
+		}
+		d.low = low
+	}
+	return d.low
+}
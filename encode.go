@@ -0,0 +1,49 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"runtime"
+	"time"
+)
+
+// encoder compresses the data written to an output file with
+// --compress-output, or encrypts it.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newEncoder(w io.Writer) (encoder, error) {
+	if ageRecipients != nil {
+		return newAgeEncoder(w)
+	}
+	return newCompressor(w, *compressOutput)
+}
+
+func newCompressor(w io.Writer, method string) (encoder, error) {
+	switch method {
+	case "gzip":
+		gz := gzip.NewWriter(w)
+		setGzipHeader(gz)
+		return gz, nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, nil
+}
+
+// setGzipHeader records when the stream started and on which system, like
+// gzip does, unless --gzip-reproducible leaves both unset so that the same
+// data always compresses to the same bytes.
+func setGzipHeader(gz *gzip.Writer) {
+	if *gzipReproducible {
+		return
+	}
+	gz.ModTime = time.Now()
+	if runtime.GOOS != "windows" {
+		// Unix
+		gz.OS = 3
+	}
+}
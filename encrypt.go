@@ -0,0 +1,79 @@
+package main
+
+import (
+	"filippo.io/age"
+	"fmt"
+	"io"
+)
+
+// the recipients of --encrypt-recipient or --encrypt-passphrase, nil when the
+// output is not encrypted
+var ageRecipients []age.Recipient
+
+// setupEncryption parses the public keys or makes a recipient of the
+// passphrase, which has to be the only one.
+func setupEncryption() error {
+	if *passphrase != "" {
+		if len(*encryptKeys) > 0 {
+			return fmt.Errorf("--encrypt-passphrase can not be used with --encrypt-recipient")
+		}
+		r, err := age.NewScryptRecipient(*passphrase)
+		if err != nil {
+			return err
+		}
+		ageRecipients = []age.Recipient{r}
+		return nil
+	}
+	for _, key := range *encryptKeys {
+		r, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return fmt.Errorf("invalid --encrypt-recipient %q: %w", key, err)
+		}
+		ageRecipients = append(ageRecipients, r)
+	}
+	return nil
+}
+
+// ageEncoder encrypts what is written, compressed before with
+// --compress-output. age seals data in chunks of 64KiB, the last one is only
+// written on Close.
+type ageEncoder struct {
+	compressor encoder
+	age        io.WriteCloser
+}
+
+func newAgeEncoder(w io.Writer) (encoder, error) {
+	a, err := age.Encrypt(w, ageRecipients...)
+	if err != nil {
+		return nil, err
+	}
+	e := &ageEncoder{age: a}
+	if e.compressor, err = newCompressor(a, *compressOutput); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *ageEncoder) Write(p []byte) (int, error) {
+	if e.compressor != nil {
+		return e.compressor.Write(p)
+	}
+	return e.age.Write(p)
+}
+
+// Flush hands the compressed data to age, a partial chunk stays with it.
+func (e *ageEncoder) Flush() error {
+	if e.compressor != nil {
+		return e.compressor.Flush()
+	}
+	return nil
+}
+
+func (e *ageEncoder) Close() error {
+	if e.compressor != nil {
+		if err := e.compressor.Close(); err != nil {
+			return err
+		}
+	}
+	return e.age.Close()
+}
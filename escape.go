@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// escapeBinary replaces bytes which are not printable UTF-8 text with \xNN,
+// keeping tabs and the trailing delimiter of the line untouched.
+func escapeBinary(line []byte) []byte {
+	escaped := make([]byte, 0, len(line))
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRune(line[i:])
+		switch {
+		case r == '\\':
+			escaped = append(escaped, '\\', '\\')
+		case r == '\t' || i == len(line)-1 && line[i] == delimiter:
+			escaped = append(escaped, line[i])
+		case r == utf8.RuneError && size <= 1 || !unicode.IsPrint(r):
+			for _, c := range line[i : i+size] {
+				escaped = append(escaped, fmt.Sprintf("\\x%02x", c)...)
+			}
+		default:
+			escaped = append(escaped, line[i:i+size]...)
+		}
+		i += size
+	}
+	return escaped
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+var (
+	execTemplate *template.Template
+	commandMutex sync.Mutex
+	commands     = make(map[*command]struct{})
+	// one for every command running with --max-exec
+	execSlots chan struct{}
+)
+
+// command is the process started by --exec for one connection, its stdin
+// takes the place of the output file.
+type command struct {
+	line  string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// checkCommandTemplate parses the template of --exec with the output of every
+// action quoted for the shell, as the fields come from the sender.
+func checkCommandTemplate(text string) (*template.Template, error) {
+	t, err := template.New("exec").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			quoteActions(tmpl.Tree, tmpl.Tree.Root)
+		}
+	}
+	err = t.Execute(io.Discard, newTemplateBinding(1, "127.0.0.1", 8080, 8080, "key", time.Now()))
+	return t, err
+}
+
+// quoteActions pipes the actions printing a value into shellquote, unless
+// they end with it already.
+func quoteActions(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			quoteActions(tree, child)
+		}
+	case *parse.ActionNode:
+		cmds := n.Pipe.Cmds
+		if len(n.Pipe.Decl) > 0 || len(cmds) == 0 {
+			return
+		}
+		if id, ok := cmds[len(cmds)-1].Args[0].(*parse.IdentifierNode); ok && id.Ident == "shellquote" {
+			return
+		}
+		n.Pipe.Cmds = append(cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      n.Pos,
+			Args:     []parse.Node{parse.NewIdentifier("shellquote").SetTree(tree).SetPos(n.Pos)},
+		})
+	case *parse.IfNode:
+		quoteActions(tree, n.List)
+		quoteActions(tree, n.ElseList)
+	case *parse.RangeNode:
+		quoteActions(tree, n.List)
+		quoteActions(tree, n.ElseList)
+	case *parse.WithNode:
+		quoteActions(tree, n.List)
+		quoteActions(tree, n.ElseList)
+	}
+}
+
+// shellquote single quotes the value as one word of sh.
+func shellquote(v interface{}) string {
+	return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", `'\''`) + "'"
+}
+
+// acquireExecSlot waits for one of the --max-exec commands to exit, at most
+// for --queue-timeout.
+func acquireExecSlot() error {
+	if execSlots == nil {
+		return nil
+	}
+	var timeout <-chan time.Time
+	if *queueTimeout > 0 {
+		timer := time.NewTimer(*queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case execSlots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return fmt.Errorf("%d commands still running after %s", *maxExec, *queueTimeout)
+	}
+}
+
+func releaseExecSlot() {
+	if execSlots != nil {
+		<-execSlots
+	}
+}
+
+func startCommand(line string) (*command, error) {
+	if err := acquireExecSlot(); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("sh", "-c", line)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		releaseExecSlot()
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		releaseExecSlot()
+		return nil, err
+	}
+	c := &command{line: line, cmd: cmd, stdin: stdin}
+	commandMutex.Lock()
+	commands[c] = struct{}{}
+	commandMutex.Unlock()
+	return c, nil
+}
+
+func (c *command) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// wait closes the stdin of the command and waits for it to exit.
+func (c *command) wait(info *connInfo) {
+	c.stdin.Close()
+	err := c.cmd.Wait()
+	commandMutex.Lock()
+	delete(commands, c)
+	commandMutex.Unlock()
+	releaseExecSlot()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		info.Error = exitErr.Error()
+		logConn(info, "error", "Command '%s' for %s exited with code %d\n", c.line, info.addr, exitErr.ExitCode())
+	} else if err != nil {
+		info.Error = err.Error()
+		logConn(info, "error", "Command '%s' for %s error: %s\n", c.line, info.addr, err.Error())
+	}
+}
+
+// killCommands stops the commands still running on exit.
+func killCommands() {
+	commandMutex.Lock()
+	defer commandMutex.Unlock()
+	for c := range commands {
+		c.cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// chunks queued per upstream before new ones are dropped
+	forwardQueueSize  = 1024
+	forwardMaxBackoff = 30 * time.Second
+	// waited on exit for the queued chunks to be sent
+	forwardDrainTimeout = 5 * time.Second
+)
+
+// forwarders relay everything received to the --forward upstreams.
+type forwarders []*forwarder
+
+func (f forwarders) Write(p []byte) (int, error) {
+	for _, fw := range f {
+		fw.send(p)
+	}
+	return len(p), nil
+}
+
+// close sends what is still queued for the upstreams on exit, giving up after
+// forwardDrainTimeout.
+func (f forwarders) close() {
+	deadline := time.Now().Add(forwardDrainTimeout)
+	for _, fw := range f {
+		fw.closeOnce.Do(func() { close(fw.closing) })
+	}
+	for _, fw := range f {
+		select {
+		case <-fw.done:
+		case <-time.After(time.Until(deadline)):
+			warn("Forward to %s not finished within %s, drop %d chunks\n", fw.addr, forwardDrainTimeout, len(fw.queue))
+		}
+	}
+}
+
+// forwarder keeps a connection to one upstream, reconnecting with backoff
+// when it fails. Data is queued so that a slow or unreachable upstream never
+// holds up receiving.
+type forwarder struct {
+	network  string
+	addr     string
+	queue    chan []byte
+	dropping int32
+	// closing is closed on exit, done once the queue is empty then
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newForwarder takes an upstream address, optionally prefixed with tcp:// or
+// udp://.
+func newForwarder(target string) (*forwarder, error) {
+	f := &forwarder{
+		network: "tcp",
+		addr:    target,
+		queue:   make(chan []byte, forwardQueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if i := strings.Index(target, "://"); i >= 0 {
+		f.network, f.addr = target[:i], target[i+3:]
+	}
+	if f.network != "tcp" && f.network != "udp" {
+		return nil, fmt.Errorf("invalid --forward network %q, expect tcp or udp", f.network)
+	}
+	go f.run()
+	return f, nil
+}
+
+func (f *forwarder) send(p []byte) {
+	select {
+	case f.queue <- append([]byte(nil), p...):
+		atomic.StoreInt32(&f.dropping, 0)
+	default:
+		if atomic.CompareAndSwapInt32(&f.dropping, 0, 1) {
+			log("Forward to %s can not keep up, drop data\n", f.addr)
+		}
+	}
+}
+
+func (f *forwarder) run() {
+	var conn net.Conn
+	var pending []byte
+	backoff := 100 * time.Millisecond
+	for {
+		if pending == nil {
+			select {
+			case pending = <-f.queue:
+			case <-f.closing:
+				select {
+				case pending = <-f.queue:
+				default:
+					if conn != nil {
+						conn.Close()
+					}
+					close(f.done)
+					return
+				}
+			}
+		}
+		if conn == nil {
+			var err error
+			if conn, err = net.Dial(f.network, f.addr); err != nil {
+				log("Forward to %s error: %s, retry in %s\n", f.addr, err.Error(), backoff)
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > forwardMaxBackoff {
+					backoff = forwardMaxBackoff
+				}
+				continue
+			}
+			backoff = 100 * time.Millisecond
+		}
+		if _, err := conn.Write(pending); err != nil {
+			log("Forward to %s error: %s\n", f.addr, err.Error())
+			conn.Close()
+			conn = nil
+			continue
+		}
+		pending = nil
+	}
+}
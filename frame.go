@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// framing splits records in line mode by --frame instead of the delimiter
+var framing *frameFormat
+
+// frameFormat is the length prefix of --frame, i.e. length:u32be.
+type frameFormat struct {
+	size  int
+	order binary.ByteOrder
+}
+
+var frameFormats = map[string]frameFormat{
+	"u8":    {1, binary.BigEndian},
+	"u16be": {2, binary.BigEndian},
+	"u16le": {2, binary.LittleEndian},
+	"u32be": {4, binary.BigEndian},
+	"u32le": {4, binary.LittleEndian},
+	"u64be": {8, binary.BigEndian},
+	"u64le": {8, binary.LittleEndian},
+}
+
+func parseFrame(text string) (*frameFormat, error) {
+	spec, ok := strings.CutPrefix(text, "length:")
+	f, known := frameFormats[spec]
+	if !ok || !known {
+		return nil, fmt.Errorf("invalid --frame %q, expect length:u8, u16be, u16le, u32be, u32le, u64be or u64le", text)
+	}
+	return &f, nil
+}
+
+func (f *frameFormat) length(header []byte) uint64 {
+	switch f.size {
+	case 1:
+		return uint64(header[0])
+	case 2:
+		return uint64(f.order.Uint16(header))
+	case 4:
+		return uint64(f.order.Uint32(header))
+	}
+	return f.order.Uint64(header)
+}
+
+// split returns whole frames of payloads up to max bytes. The prefix is kept so
+// that the output can be split the same way.
+func (f *frameFormat) split(max int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if len(data) < f.size {
+			if atEOF && len(data) > 0 {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			return 0, nil, nil
+		}
+		n := f.length(data[:f.size])
+		if n > uint64(max) {
+			return 0, nil, fmt.Errorf("frame of %d bytes is longer than %d bytes", n, max)
+		}
+		end := f.size + int(n)
+		if len(data) < end {
+			if atEOF {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			return 0, nil, nil
+		}
+		return end, data[:end], nil
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// gzipIndexWriter compresses an output file for --gzip-index. Every flush
+// ends a gzip member and starts a new one, and '<name>.gzi' lists where each
+// member starts in the compressed and uncompressed data, so that readers can
+// seek to the member before an offset instead of decompressing from the
+// start. The index is a little endian uint64 count of points followed by
+// the compressed and uncompressed uint64 offsets of every point, the first
+// one is that of the stream and the last one its end once it is closed.
+type gzipIndexWriter struct {
+	gz *gzip.Writer
+	w  io.Writer
+	// w counting the compressed bytes
+	counter io.Writer
+	index   *os.File
+	// count of the points in index
+	points int64
+	// of the data written so far
+	compressed   int64
+	uncompressed int64
+	// written since the last point
+	pending bool
+}
+
+// newGzipIndexWriter starts the stream at offset of the output file, which
+// is appended to when it is not empty. Its index has to end there then,
+// otherwise the file is compressed without one.
+func newGzipIndexWriter(w io.Writer, path string, offset int64) (encoder, error) {
+	e := &gzipIndexWriter{w: w, compressed: offset}
+	e.counter = writerFunc(func(p []byte) (int, error) {
+		n, err := e.w.Write(p)
+		e.compressed += int64(n)
+		return n, err
+	})
+	e.gz = gzip.NewWriter(e.counter)
+	setGzipHeader(e.gz)
+	name := path + ".gzi"
+	if offset == 0 {
+		index, err := os.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		e.index = index
+		if err = e.addPoint(); err != nil {
+			index.Close()
+			return nil, err
+		}
+		return e, nil
+	}
+	points, err := readGzipIndex(name)
+	if err != nil || len(points) == 0 || points[len(points)-1][0] != offset {
+		warn("Warning: %s does not end at the size of %s, append without an index\n", name, path)
+		return e.gz, nil
+	}
+	if e.index, err = os.OpenFile(name, os.O_RDWR, 0644); err != nil {
+		return nil, err
+	}
+	e.points = int64(len(points))
+	e.uncompressed = points[len(points)-1][1]
+	return e, nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func (e *gzipIndexWriter) Write(p []byte) (int, error) {
+	n, err := e.gz.Write(p)
+	e.uncompressed += int64(n)
+	if n > 0 {
+		e.pending = true
+	}
+	return n, err
+}
+
+// Flush ends the member, unless nothing was written to it.
+func (e *gzipIndexWriter) Flush() error {
+	if !e.pending {
+		return nil
+	}
+	if err := e.gz.Close(); err != nil {
+		return err
+	}
+	e.gz.Reset(e.counter)
+	setGzipHeader(e.gz)
+	e.pending = false
+	return e.addPoint()
+}
+
+func (e *gzipIndexWriter) Close() error {
+	err := e.Flush()
+	if cerr := e.index.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// addPoint appends the current offsets to the index and updates its count.
+func (e *gzipIndexWriter) addPoint() error {
+	var point [16]byte
+	binary.LittleEndian.PutUint64(point[:8], uint64(e.compressed))
+	binary.LittleEndian.PutUint64(point[8:], uint64(e.uncompressed))
+	if _, err := e.index.WriteAt(point[:], 8+16*e.points); err != nil {
+		return err
+	}
+	e.points++
+	var count [8]byte
+	binary.LittleEndian.PutUint64(count[:], uint64(e.points))
+	_, err := e.index.WriteAt(count[:], 0)
+	return err
+}
+
+// readGzipIndex returns the compressed and uncompressed offsets of the points
+// of the index file.
+func readGzipIndex(name string) ([][2]int64, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		return nil, errors.New("gzip index too short")
+	}
+	count := binary.LittleEndian.Uint64(data)
+	if uint64(len(data)-8)/16 < count {
+		return nil, fmt.Errorf("gzip index of %d points too short", count)
+	}
+	points := make([][2]int64, count)
+	for i := range points {
+		p := data[8+16*i:]
+		points[i] = [2]int64{int64(binary.LittleEndian.Uint64(p)), int64(binary.LittleEndian.Uint64(p[8:]))}
+	}
+	return points, nil
+}
+
+// openGzipAt returns the uncompressed data of a file written with
+// --gzip-index from offset on, decompressing from the last member starting
+// before it.
+func openGzipAt(path string, offset int64) (io.ReadCloser, error) {
+	points, err := readGzipIndex(path + ".gzi")
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 || offset > points[len(points)-1][1] {
+		return nil, fmt.Errorf("offset %d is beyond the end of %s", offset, path)
+	}
+	// strictly before offset, no member starts at the offset of the end
+	var start [2]int64
+	for _, p := range points {
+		if p[1] >= offset {
+			break
+		}
+		start = p
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(start[0], io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err = io.CopyN(io.Discard, gz, offset-start[1]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipSeekReader{gz, f}, nil
+}
+
+// readGzipAt writes the data of --read-gzip from the offset on to stdout.
+func readGzipAt(path string, offset int64) error {
+	if offset < 0 {
+		return errors.New("--read-offset can not be negative")
+	}
+	r, err := openGzipAt(path, offset)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err = io.Copy(os.Stdout, r); errors.Is(err, syscall.EPIPE) {
+		// i.e. `recv.sh --read-gzip capture.gz | head`
+		return nil
+	}
+	return err
+}
+
+type gzipSeekReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r *gzipSeekReader) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenGzipAt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newGzipIndexWriter(f, path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, member := range []string{"first\n", "second\n", "third\n"} {
+		if _, err = e.Write([]byte(member)); err != nil {
+			t.Fatal(err)
+		}
+		if err = e.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	points, err := readGzipIndex(path + ".gzi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 4 || points[3][1] != int64(len("first\nsecond\nthird\n")) {
+		t.Fatalf("points %v", points)
+	}
+	for _, test := range []struct {
+		offset int64
+		want   string
+	}{
+		{0, "first\nsecond\nthird\n"},
+		{6, "second\nthird\n"},
+		{9, "ond\nthird\n"},
+		{13, "third\n"},
+		{19, ""},
+	} {
+		r, err := openGzipAt(path, test.offset)
+		if err != nil {
+			t.Fatalf("offset %d: %s", test.offset, err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(data) != test.want {
+			t.Errorf("offset %d: got %q, %v, want %q", test.offset, data, err, test.want)
+		}
+	}
+	if _, err = openGzipAt(path, 20); err == nil {
+		t.Error("offset 20 beyond the end opened")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// the header is a single line, do not buffer a whole stream looking for it
+const maxHeaderLen = 4096
+
+// fileHeader is the first line of a connection with --header, i.e.
+// 'FILE photos/a.jpg SIZE 1234'.
+type fileHeader struct {
+	name string
+	size int64 // -1 when not given
+}
+
+func parseFileHeader(line string) (*fileHeader, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid header %q", line)
+	}
+	h := &fileHeader{size: -1}
+	for i := 0; i < len(fields); i += 2 {
+		switch value := fields[i+1]; strings.ToUpper(fields[i]) {
+		case "FILE":
+			// like the path of --http, the name can not climb up with '..'
+			h.name = strings.TrimPrefix(path.Clean("/"+value), "/")
+		case "SIZE":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("invalid header size %q", value)
+			}
+			h.size = size
+		}
+	}
+	if h.name == "" {
+		return nil, fmt.Errorf("header %q without FILE", line)
+	}
+	return h, nil
+}
+
+// routeByHeader consumes the --header line of reader and opens the output file
+// it names. With a SIZE the returned reader ends after that many bytes, and
+// fails when the connection closes earlier. Connections without a valid header
+// are discarded, in which case the returned output file is nil.
+func routeByHeader(reader io.Reader, t *template.Template, info *connInfo) (io.Reader, *outputFile) {
+	bufReader := bufio.NewReaderSize(reader, maxHeaderLen)
+	line, err := bufReader.ReadSlice('\n')
+	if err != nil {
+		log("Discard connection %s without header: %s\n", info.addr, err.Error())
+		return nil, nil
+	}
+	h, err := parseFileHeader(string(line))
+	if err != nil {
+		log("Discard connection %s: %s\n", info.addr, err.Error())
+		return nil, nil
+	}
+	outputFile := getOutputFile(t, info, h.name)
+	if h.size < 0 {
+		return bufReader, outputFile
+	}
+	return &sizedReader{reader: bufReader, left: h.size}, outputFile
+}
+
+// sizedReader reads exactly the size announced by the header.
+type sizedReader struct {
+	reader io.Reader
+	left   int64
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.reader.Read(p)
+	r.left -= int64(n)
+	if err == io.EOF && r.left > 0 {
+		err = fmt.Errorf("connection closed %d bytes short of the header size", r.left)
+	}
+	return n, err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+const hexDumpWidth = 16
+
+// hexDumper writes an xxd style dump of the data written to it, offsets
+// continue over all writes of a connection.
+type hexDumper struct {
+	w      io.Writer
+	offset int64
+	buf    [hexDumpWidth]byte
+	n      int
+}
+
+func (d *hexDumper) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); {
+		c := copy(d.buf[d.n:], p[i:])
+		d.n += c
+		i += c
+		if d.n == hexDumpWidth {
+			if err := d.flush(); err != nil {
+				return i, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Close dumps the last, partial line.
+func (d *hexDumper) Close() error {
+	if d.n == 0 {
+		return nil
+	}
+	return d.flush()
+}
+
+func (d *hexDumper) flush() error {
+	line := make([]byte, 0, 80)
+	line = append(line, fmt.Sprintf("%08x: ", d.offset)...)
+	for i := 0; i < hexDumpWidth; i += 2 {
+		for j := i; j < i+2; j++ {
+			if j < d.n {
+				line = append(line, hex.EncodeToString(d.buf[j:j+1])...)
+			} else {
+				line = append(line, ' ', ' ')
+			}
+		}
+		line = append(line, ' ')
+	}
+	line = append(line, ' ')
+	for _, c := range d.buf[:d.n] {
+		if c < 0x20 || c > 0x7e {
+			c = '.'
+		}
+		line = append(line, c)
+	}
+	line = append(line, '\n')
+	d.offset += int64(d.n)
+	d.n = 0
+	_, err := d.w.Write(line)
+	return err
+}
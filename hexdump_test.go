@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHexDumper(t *testing.T) {
+	var out bytes.Buffer
+	d := &hexDumper{w: &out}
+	// the offsets continue over writes not ending at a line
+	for _, p := range []string{"Hello, ", "recv.sh!\n\x00\x01", "\x02\xffbinary"} {
+		if _, err := d.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// as printed by xxd
+	want := "00000000: 4865 6c6c 6f2c 2072 6563 762e 7368 210a  Hello, recv.sh!.\n" +
+		"00000010: 0001 02ff 6269 6e61 7279                 ....binary\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// connContextKey is the context key of the connection a request came in on.
+type connContextKey struct{}
+
+// serveHttp handles the body of every POST or PUT request on l like the data
+// of a tcp connection, and the clients of --ws.
+func serveHttp(l net.Listener) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// before takeCount, which lets main wait for the last request of --count
+		inflight.Add(1)
+		defer inflight.Done()
+		t := currentFileTemplate()
+		if *wsMode && (!*httpMode || websocket.IsWebSocketUpgrade(r)) {
+			handleWsClient(t, w, r)
+			return
+		}
+		handleUpload(t, w, r)
+	})
+	server := &http.Server{
+		Handler: handler,
+		// a body is bounded by --timeout like the data of a tcp connection,
+		// see handleUpload
+		ReadHeaderTimeout: *timeout,
+		IdleTimeout:       *timeout,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+	err := server.Serve(l)
+	if atomic.LoadInt32(&shuttingDown) == 1 || listenerRemoved(l) {
+		return
+	}
+	exit(err)
+}
+
+func handleUpload(t *template.Template, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info := acceptRequest(w, r)
+	if info == nil {
+		return
+	}
+	handleMutex.Lock()
+	defer func() {
+		handleMutex.Unlock()
+		releaseConnSlot()
+	}()
+
+	var outputFile *outputFile
+	var reader io.Reader = r.Body
+	if *timeout > 0 || *maxConnDuration > 0 {
+		rc := http.NewResponseController(w)
+		body := &deadlineReader{conn: requestBody{r.Body, w, rc}, timeout: *timeout, start: time.Now()}
+		defer func() {
+			// the connection of a body cut short is closed after the reply
+			if body.err == nil {
+				rc.SetReadDeadline(time.Time{})
+			}
+		}()
+		reader = body
+	}
+	if *firstLineKey {
+		reader, outputFile = routeByFirstLine(reader, t, info)
+	} else {
+		outputFile = getOutputFile(t, info, "")
+	}
+	if outputFile == nil {
+		http.Error(w, "no output for the request", http.StatusBadRequest)
+		return
+	}
+	handleRequest(reader, info, outputFile)
+	if info.Error != "" {
+		http.Error(w, info.Error, http.StatusBadRequest)
+		return
+	}
+	if reply := ackReply(info); reply != nil {
+		w.Write(reply)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// acceptRequest applies the checks of a tcp connection to the request and
+// takes a connection slot, which the caller releases. It replies the error and
+// returns nil when the request is refused.
+func acceptRequest(w http.ResponseWriter, r *http.Request) *connInfo {
+	// not r.RemoteAddr, which is no host:port on a unix socket
+	conn := r.Context().Value(connContextKey{}).(net.Conn)
+	addr := conn.RemoteAddr()
+	if !checkAllowed(addr) {
+		log("Reject request from %s, not allowed\n", addr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil
+	}
+	if !checkDistinctIp(addr) {
+		log("Reject request from %s\n", addr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return nil
+	}
+	if !takeCount() {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return nil
+	}
+	connId := atomic.AddInt64(&id, 1)
+	info := newConnInfo(addr, connId)
+	info.local, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	info.request = r
+	if *unixSocket {
+		info.Pid, info.Uid = peerCred(conn)
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		info.CN = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	queued, ok := queueConnSlot()
+	if !ok || !waitConnSlot(queued) {
+		log("Reject request from %s, too many requests\n", addr)
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return nil
+	}
+	return info
+}
+
+// uploadPath is the cleaned path of the request, it can not climb up with '..'.
+func uploadPath(r *http.Request) string {
+	return path.Clean("/" + r.URL.Path)
+}
+
+// requestBody is the body of a request as a streamConn, so that
+// deadlineReader applies --timeout and --max-conn-duration to reading it.
+type requestBody struct {
+	io.Reader
+	io.Writer
+	rc *http.ResponseController
+}
+
+func (b requestBody) SetReadDeadline(t time.Time) error {
+	return b.rc.SetReadDeadline(t)
+}
+
+func (b requestBody) SetWriteDeadline(t time.Time) error {
+	return b.rc.SetWriteDeadline(t)
+}
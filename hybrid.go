@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// A record in hybrid mode is a run of at least hybridMinRecord printable
+// ASCII bytes (tabs and carriage returns included) ended by '\n'. Any other
+// byte breaks the run, and runs longer than hybridMaxRecord are ignored.
+const (
+	hybridMinRecord = 4
+	hybridMaxRecord = 64 * 1024
+)
+
+var (
+	recordsFile  *os.File
+	recordsMutex sync.Mutex
+)
+
+type recordDetector struct {
+	info     *connInfo
+	run      []byte
+	overflow bool
+}
+
+func (d *recordDetector) Write(p []byte) (int, error) {
+	for _, c := range p {
+		switch {
+		case c == '\n':
+			if !d.overflow && len(d.run) >= hybridMinRecord {
+				d.emit(append(d.run, c))
+			}
+			d.run = d.run[:0]
+			d.overflow = false
+		case c >= 0x20 && c < 0x7f || c == '\t' || c == '\r':
+			if len(d.run) < hybridMaxRecord {
+				d.run = append(d.run, c)
+			} else {
+				d.overflow = true
+			}
+		default:
+			d.run = d.run[:0]
+			d.overflow = false
+		}
+	}
+	return len(p), nil
+}
+
+func (d *recordDetector) emit(record []byte) {
+	d.info.Lines++
+	if recordsFile == nil {
+		log("Record from %s: %s", d.info.addr, record)
+		return
+	}
+	recordsMutex.Lock()
+	defer recordsMutex.Unlock()
+	if _, err := recordsFile.Write(record); err != nil {
+		log("Write records file error: %s\n", err.Error())
+	}
+}
+
+// handleRequestInHybrid copies the stream like chunk mode does, and picks out
+// the text records embedded in it.
+func handleRequestInHybrid(reader io.Reader, info *connInfo, file *outputFile) {
+	defer func() {
+		logConn(info, "close", "Connection %s closed, read bytes %d, records %d%s\n", info.addr, info.Bytes, info.Lines, limitNote(info))
+	}()
+	buf := chunkBufferPool.Get()
+	defer chunkBufferPool.Put(buf, len(*buf))
+	detector := &recordDetector{info: info}
+	dst, done := chunkWriter(info, file)
+	defer done()
+	var err error
+	info.Bytes, err = io.CopyBuffer(io.MultiWriter(dst, detector), reader, *buf)
+	if err != nil {
+		logReadError(info, err)
+	}
+}
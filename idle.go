@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// idleSyncer syncs the output file of a connection once the connection has
+// not written anything for the --flush-on-idle duration, leaving it open.
+type idleSyncer struct {
+	last    int64 // first for 64-bit atomic alignment
+	file    *outputFile
+	pending int32
+	done    chan struct{}
+}
+
+func startIdleSyncer(file *outputFile, idle time.Duration) *idleSyncer {
+	s := &idleSyncer{
+		file: file,
+		done: make(chan struct{}),
+	}
+	go s.loop(idle)
+	return s
+}
+
+func (s *idleSyncer) loop(idle time.Duration) {
+	interval := idle / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&s.last))
+			if time.Since(last) >= idle && atomic.CompareAndSwapInt32(&s.pending, 1, 0) {
+				log("Sync %s after idle\n", s.file.name)
+				if err := s.file.Sync(); err != nil {
+					log("Sync error: %s\n", err.Error())
+				}
+			}
+		}
+	}
+}
+
+func (s *idleSyncer) touch() {
+	if s == nil {
+		return
+	}
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+	atomic.StoreInt32(&s.pending, 1)
+}
+
+func (s *idleSyncer) Write(p []byte) (int, error) {
+	s.touch()
+	return len(p), nil
+}
+
+func (s *idleSyncer) Stop() {
+	if s == nil {
+		return
+	}
+	close(s.done)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// logOutput receives the logs, stderr unless --log-file is given.
+var logOutput io.Writer = os.Stderr
+
+// logEvent is a line of --log-format json.
+type logEvent struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+	*connEvent
+}
+
+// connEvent holds the fields of events about a connection.
+type connEvent struct {
+	Event     string  `json:"event"`
+	Id        int64   `json:"id"`
+	Peer      string  `json:"peer"`
+	Ip        string  `json:"ip,omitempty"`
+	Port      int     `json:"port,omitempty"`
+	Seq       int64   `json:"seq"`
+	File      string  `json:"file,omitempty"`
+	Bytes     int64   `json:"bytes"`
+	Lines     int64   `json:"lines"`
+	Rejected  int64   `json:"rejected,omitempty"`
+	Duration  float64 `json:"duration"`
+	Error     string  `json:"error,omitempty"`
+	CN        string  `json:"cn,omitempty"`
+	Pid       *int    `json:"pid,omitempty"`
+	Uid       *int    `json:"uid,omitempty"`
+	Throttled bool    `json:"throttled,omitempty"`
+	Truncated bool    `json:"truncated,omitempty"`
+}
+
+func openLogFile(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	logOutput = f
+	return nil
+}
+
+// writeLogEvent writes msg as a single json line, with the fields of info
+// when it is about a connection.
+func writeLogEvent(level, msg string, info *connInfo) {
+	e := logEvent{
+		Time:  time.Now().Format(time.RFC3339Nano),
+		Level: level,
+		Msg:   strings.TrimRight(msg, "\n"),
+	}
+	if info != nil {
+		e.connEvent = &connEvent{
+			Event:     info.Event,
+			Id:        info.Id,
+			Peer:      info.addr.String(),
+			Ip:        info.Ip,
+			Port:      info.Port,
+			Seq:       info.Seq,
+			Bytes:     info.Bytes,
+			Lines:     info.Lines,
+			Rejected:  info.Rejected,
+			Duration:  info.Duration.Seconds(),
+			Error:     info.Error,
+			CN:        info.CN,
+			Throttled: info.Throttled,
+			Truncated: info.Truncated,
+		}
+		if info.output != nil {
+			e.File = info.output.label()
+		}
+		if info.Pid >= 0 {
+			e.Pid, e.Uid = &info.Pid, &info.Uid
+		}
+	}
+	writeEventLine(e)
+}
+
+func writeEventLine(e logEvent) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	// a single write keeps lines of concurrent connections apart
+	logOutput.Write(append(line, '\n'))
+}
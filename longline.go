@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// lineSplitter splits lines like scanLines, applying --on-long-line to lines
+// longer than max bytes (not counting the newline) instead of failing with
+// bufio.ErrTooLong.
+type lineSplitter struct {
+	max        int
+	policy     string
+	info       *connInfo
+	discarding bool
+	truncated  bool
+}
+
+func (s *lineSplitter) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	s.truncated = false
+	if s.discarding {
+		if i := bytes.IndexByte(data, delimiter); i >= 0 {
+			s.discarding = false
+			return i + 1, nil, nil
+		}
+		return len(data), nil, nil
+	}
+	advance, token, err = scanLines(data, atEOF)
+	if token != nil || len(data) <= s.max {
+		return
+	}
+	switch s.policy {
+	case "truncate-write":
+		log("Line from %s is longer than %d bytes, truncate it\n", s.info.addr, s.max)
+		s.discarding = true
+		s.truncated = true
+		return s.max, data[:s.max], nil
+	case "skip":
+		log("Line from %s is longer than %d bytes, skip it\n", s.info.addr, s.max)
+		s.discarding = true
+		return s.max, nil, nil
+	}
+	return 0, nil, bufio.ErrTooLong
+}
@@ -3,213 +3,1773 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"hash/fnv"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"text/template"
+	"time"
+	"unicode/utf8"
 )
 
 var (
-	addr    = kingpin.Arg("[host]:port", "Listening address").Required().String()
-	file    = kingpin.Arg("file", "Specify output file name, support Go template, i.e. 'out-{{.Id}}-{{.Ip}}-{{.Port}}'").String()
-	gz      = kingpin.Flag("gzip", "Accept gzipped data").Short('z').Bool()
+	addr    = kingpin.Arg("[host]:port", "Listening address, comma separated for several ones, a tcp:// or udp:// prefix picks the protocol of one, left out with --fd").String()
+	file    = kingpin.Arg("file", "Specify output file name, support Go template, i.e. 'out-{{.Date}}/{{.Time}}-{{.Id}}-{{.Ip}}-{{.Port}}'").String()
+	gz      = kingpin.Flag("gzip", "Accept gzipped data, other data is read as is, see --compress=auto for more formats").Short('z').Bool()
 	app     = kingpin.Flag("append", "Append data to the output file when writing").Short('a').Bool()
 	mutex   = kingpin.Flag("mutex", "Read data one by one").Short('m').Bool()
 	chunk   = kingpin.Flag("chunk", "Read data in chunk mode, default (line mode)").Short('c').Bool()
+	hybrid  = kingpin.Flag("hybrid", "Read data in chunk mode, additionally picking out text records").Bool()
 	udp     = kingpin.Flag("udp", "Use udp instead of the default option of tcp").Short('u').Bool()
-	bufSize = kingpin.Flag("bufsize", "Sepcify read buffer size on udp").Default("64KB").Bytes()
+	bufSize = kingpin.Flag("bufsize", "Sepcify read buffer size on udp, and of --buffered output").Default("64KB").Bytes()
 	verbose = kingpin.Flag("verbose", "Verbose").Short('v').Bool()
+
+	maxDistinctIps   = kingpin.Flag("max-distinct-ips", "Warn when the number of distinct source IPs exceeds the limit, also counted in the summary on exit").PlaceHolder("N").Int()
+	rejectNewIps     = kingpin.Flag("reject-new-ips", "Reject new source IPs once --max-distinct-ips is exceeded, also counted in the summary on exit").Bool()
+	latestSymlink    = kingpin.Flag("latest-symlink", "Maintain a symlink pointing to the most recently opened output file").PlaceHolder("PATH").String()
+	udpReaders       = kingpin.Flag("udp-readers", "Number of goroutines reading datagrams concurrently on udp").Default("1").Int()
+	strictSingleFile = kingpin.Flag("strict-single-file", "Require a single fixed output file for all connections").Bool()
+	statsdAddr       = kingpin.Flag("statsd", "Send metrics to the StatsD server").PlaceHolder("HOST:PORT").String()
+	statsdPrefix     = kingpin.Flag("statsd-prefix", "Prefix of StatsD metric names").Default("recv.").String()
+	jsonSchema       = kingpin.Flag("json-schema", "Validate each line against the JSON schema in line mode").PlaceHolder("FILE").String()
+	rejectFileName   = kingpin.Flag("reject-file", "Write lines failing validation to the file instead of dropping them").PlaceHolder("FILE").String()
+	poolBuffers      = kingpin.Flag("pool-buffers", "Reuse read buffers across connections to reduce allocations").Bool()
+	wsAddr           = kingpin.Flag("ws-addr", "Broadcast received data to WebSocket clients connected to the address").PlaceHolder("[HOST]:PORT").String()
+	logTemplateText  = kingpin.Flag("log-template", "Go template of verbose connection logs, i.e. '{{.Event}} {{.Ip}}:{{.Port}} {{.Bytes}}'").PlaceHolder("TEMPLATE").String()
+	dailyAppend      = kingpin.Flag("daily-append", "Append data to one output file per day, named with a '.YYYY-MM-DD' suffix").Bool()
+	firstLineKey     = kingpin.Flag("first-line-key", "Use the first line of each connection as {{.Key}} of the output file name, or as the name itself").Bool()
+	flushOnIdle      = kingpin.Flag("flush-on-idle", "Sync the output file to disk once a connection has been idle for the duration").PlaceHolder("DURATION").Duration()
+	lineSample       = kingpin.Flag("line-sample", "Write only the first of every N lines per output file in line mode").PlaceHolder("N").Int64()
+	tailAddr         = kingpin.Flag("tail-addr", "Serve new data of output files over http on /tail/<file>").PlaceHolder("[HOST]:PORT").String()
+	maxTailers       = kingpin.Flag("max-tailers", "Maximum number of concurrent http tailers").Default("16").Int()
+	emptyNamePolicy  = kingpin.Flag("empty-name-policy", "What to do when the output file template renders an empty name: stdout, error or default-name").Default("stdout").Enum("stdout", "error", "default-name")
+	defaultName      = kingpin.Flag("default-name", "Output file name used by --empty-name-policy=default-name").PlaceHolder("FILE").String()
+	escapeBinaryData = kingpin.Flag("escape-binary", "Escape non-printable bytes as \\xNN in line mode").Bool()
+	recordsFileName  = kingpin.Flag("records-file", "Write text records found in --hybrid mode to the file instead of the verbose log").PlaceHolder("FILE").String()
+	diskRate         = kingpin.Flag("disk-rate", "Limit writing to output files to the bytes per second").PlaceHolder("BYTES").Bytes()
+	diskBuffer       = kingpin.Flag("disk-buffer", "Buffer size per output file in front of --disk-rate or --async-writes").Default("1MB").Bytes()
+	tarOutputName    = kingpin.Flag("tar-output", "Write every connection as an entry of a tar archive, compressed by --compress-output or a .tar.gz name, named by the output file template or {{.Id}} by default, '-' for stdout").PlaceHolder("FILE").String()
+	tarSpill         = kingpin.Flag("tar-spill", "Keep tar entries larger than the size in temporary files instead of memory").Default("4MB").Bytes()
+	otelEndpoint     = kingpin.Flag("otel", "Export a trace span per connection to the OpenTelemetry collector over OTLP/HTTP").PlaceHolder("HOST:PORT").String()
+	perIpRate        = kingpin.Flag("per-ip-rate", "Limit reading from every source IP to the bytes per second").PlaceHolder("BYTES").Bytes()
+	ignoreEmpty      = kingpin.Flag("ignore-empty-datagrams", "Drop zero-length udp datagrams, by default they are handled as empty data").Bool()
+	requireMagicHex  = kingpin.Flag("require-magic", "Drop connections and datagrams not starting with the hex bytes").PlaceHolder("HEX").String()
+	stripMagic       = kingpin.Flag("strip-magic", "Do not write the --require-magic bytes to the output").Bool()
+	maxLine          = kingpin.Flag("max-line", "Maximum line length in line mode, unlimited by default").PlaceHolder("BYTES").Bytes()
+	onLongLine       = kingpin.Flag("on-long-line", "What to do with a line longer than --max-line: close, skip or truncate-write").Default("close").Enum("close", "skip", "truncate-write")
+	mmapOutput       = kingpin.Flag("mmap", "Write output files through a memory mapping, growing them in chunks").Bool()
+	auditCsv         = kingpin.Flag("audit-csv", "Append a CSV row for every finished connection to the file").PlaceHolder("FILE").String()
+	requireUtf8      = kingpin.Flag("require-utf8", "Reject lines which are not valid UTF-8 in line mode").Bool()
+	controlPath      = kingpin.Flag("control-socket", "Write a line with the output file and bytes of every finished connection to clients of the unix socket").PlaceHolder("PATH").String()
+	noDelay          = kingpin.Flag("no-delay", "Disable Nagle's algorithm on accepted tcp connections").Bool()
+	maxNameLen       = kingpin.Flag("max-name-len", "Shorten generated output file names longer than the bytes, 0 for no limit").Default("255").Int()
+	walDir           = kingpin.Flag("wal", "Log every connection to a file in the directory before writing it to the output, and replay logs left by a crash on startup, requires --append or --daily-append").PlaceHolder("DIR").String()
+	walSync          = kingpin.Flag("wal-sync", "Interval of syncing the --wal logs to disk").Default("1s").Duration()
+	tlsCert          = kingpin.Flag("tls-cert", "Accept tls connections with the certificate, requires --tls-key").PlaceHolder("FILE").String()
+	tlsKey           = kingpin.Flag("tls-key", "Private key of --tls-cert").PlaceHolder("FILE").String()
+	unixDgram        = kingpin.Flag("unix-dgram", "Receive datagrams on the unix socket path given as address, like --udp").Bool()
+	tlsClientCa      = kingpin.Flag("tls-client-ca", "Require tls clients to present a certificate signed by the CA, its common name is {{.CN}}").PlaceHolder("FILE").String()
+	maxSize          = kingpin.Flag("max-size", "Continue in a new output file with a numeric suffix once the current one reaches the size, 0 for no limit").Default("0").Bytes()
+	timeout          = kingpin.Flag("timeout", "Close tcp connections idle for longer than the duration").PlaceHolder("DURATION").Duration()
+	unixSocket       = kingpin.Flag("unix", "Listen on the unix socket path given as address instead of tcp").Bool()
+	compress         = kingpin.Flag("compress", "Decompress data: auto (detect gzip, zstd, xz, bzip2 or zlib), gzip, zstd, xz, bzip2, zlib, deflate or none").Default("none").Enum("auto", "gzip", "zstd", "xz", "bzip2", "zlib", "deflate", "none")
+	count            = kingpin.Flag("count", "Exit after handling the number of connections or datagrams").PlaceHolder("N").Int64()
+	maxConn          = kingpin.Flag("max-conn", "Handle at most the number of connections or datagrams at once, further ones wait").PlaceHolder("N").Int()
+	allow            = kingpin.Flag("allow", "Only accept data from the CIDR or address, can be repeated").PlaceHolder("CIDR").Strings()
+	prefix           = kingpin.Flag("prefix", "Prepend the Go template to every line in line mode, i.e. '{{.Timestamp}} {{.Ip}} '").PlaceHolder("TEMPLATE").String()
+	delimiterText    = kingpin.Flag("delimiter", "Split records in line mode at the byte instead of newline, a character or an escape like \\0, \\t or \\xNN").PlaceHolder("BYTE").String()
+	readRate         = kingpin.Flag("rate", "Limit reading from every connection to the bytes per second").PlaceHolder("BYTES").Bytes()
+	hexDump          = kingpin.Flag("hex", "Write a hex dump of the data like xxd does, implies --chunk unless --hybrid").Bool()
+	execText         = kingpin.Flag("exec", "Pipe every connection into a shell command instead of the output file, support Go template with the fields quoted for the shell, i.e. 'gzip > {{.Ip}}.gz'").PlaceHolder("COMMAND").String()
+	ackText          = kingpin.Flag("ack", "Reply the Go template to the sender once its data is received, i.e. 'OK {{.Bytes}}{{\"\\n\"}}'").PlaceHolder("TEMPLATE").String()
+	buffered         = kingpin.Flag("buffered", "Buffer writes to the output files in memory of --bufsize").Bool()
+	flushInterval    = kingpin.Flag("flush-interval", "Flush --buffered output at the interval, 0 only when the buffer is full or a connection closes").Default("1s").Duration()
+	rotateInterval   = kingpin.Flag("rotate-interval", "Continue in a new output file with a numeric suffix once the current one is open for the duration, like --max-size").PlaceHolder("DURATION").Duration()
+	drainTimeout     = kingpin.Flag("drain-timeout", "Exit once connections have not finished within the duration after SIGINT or SIGTERM, 0 to wait for them").PlaceHolder("DURATION").Duration()
+	httpMode         = kingpin.Flag("http", "Serve http and handle the body of every POST or PUT request as a connection").Bool()
+	metricsAddr      = kingpin.Flag("metrics-addr", "Serve prometheus metrics on /metrics of the address").PlaceHolder("ADDR").String()
+	compressOutput   = kingpin.Flag("compress-output", "Compress the output files: gzip, zstd or none").Default("none").Enum("gzip", "zstd", "none")
+	deny             = kingpin.Flag("deny", "Refuse data from the CIDR or address, can be repeated and wins over --allow").PlaceHolder("CIDR").Strings()
+	proxyProtocol    = kingpin.Flag("proxy-protocol", "Read the client address from the PROXY protocol v1 or v2 header sent by a load balancer").Bool()
+	udpIdleTimeout   = kingpin.Flag("udp-idle-timeout", "Handle the datagrams of a sender as one connection until it sent nothing for the duration").PlaceHolder("DURATION").Duration()
+	queueSize        = kingpin.Flag("queue-size", "Let at most the number of connections wait for --max-conn instead of the listen backlog, further ones are refused").PlaceHolder("N").Int()
+	queueTimeout     = kingpin.Flag("queue-timeout", "Refuse connections waiting for --max-conn, in --queue-size or the accept loop, for longer than the duration").PlaceHolder("DURATION").Duration()
+	forward          = kingpin.Flag("forward", "Relay all data received to the upstream [tcp://|udp://]host:port as well, can be repeated").PlaceHolder("ADDR").Strings()
+	checksum         = kingpin.Flag("checksum", "Hash the data of every connection and write a manifest line with the digest: sha256, md5, crc32 or none").Default("none").Enum("sha256", "md5", "crc32", "none")
+	manifestFile     = kingpin.Flag("manifest", "Append the lines of --checksum to the file instead of stderr").PlaceHolder("FILE").String()
+	header           = kingpin.Flag("header", "Read a 'FILE name [SIZE bytes]' line first on every tcp connection, the name is {{.Key}} of the output file name, or the name itself").Bool()
+	logFormat        = kingpin.Flag("log-format", "Format of the logs: text or json, one object per line").Default("text").Enum("text", "json")
+	logFileName      = kingpin.Flag("log-file", "Append the logs to the file instead of stderr").PlaceHolder("FILE").String()
+	maxConnDuration  = kingpin.Flag("max-conn-duration", "Close tcp connections still sending after the duration, also with --mutex").PlaceHolder("DURATION").Duration()
+	atomicOutput     = kingpin.Flag("atomic", "Write every connection to '<name>.part' and rename it to the output file name once the connection ended without error").Bool()
+	maxOpenFiles     = kingpin.Flag("max-open-files", "Keep at most the number of output files open, closing the least recently written ones").PlaceHolder("N").Int()
+	fileIdleTimeout  = kingpin.Flag("file-idle-timeout", "Close output files not written for the duration, they are opened again in append mode").PlaceHolder("DURATION").Duration()
+	maxRate          = kingpin.Flag("max-rate", "Limit reading from all connections together to the bytes per second, see --rate for every connection").PlaceHolder("BYTES").Bytes()
+	maxConnBytes     = kingpin.Flag("max-bytes-per-conn", "Close connections sending more than the bytes, after decompression, as failed").PlaceHolder("BYTES").Bytes()
+	wsMode           = kingpin.Flag("ws", "Serve websocket and handle the messages of every client as a connection").Bool()
+	wsMessageLines   = kingpin.Flag("ws-message-lines", "End every message of --ws with the delimiter unless it does already").Bool()
+	quicMode         = kingpin.Flag("quic", "Accept QUIC connections of the ALPN protocol recv.sh and handle every stream like a tcp connection, requires --tls-cert").Bool()
+	multicastGroup   = kingpin.Flag("multicast-group", "Join the multicast group on the port of the address with --udp").PlaceHolder("IP").String()
+	multicastIface   = kingpin.Flag("interface", "Network interface to join --multicast-group on, the system default otherwise").PlaceHolder("NAME").String()
+	frameText        = kingpin.Flag("frame", "Split records in line mode by a length prefix instead of the delimiter: length:u8, u16be, u16le, u32be, u32le, u64be or u64le").PlaceHolder("FORMAT").String()
+	grep             = kingpin.Flag("grep", "Write only lines matching the regular expression in line mode, can be repeated to match any").PlaceHolder("REGEX").Strings()
+	grepV            = kingpin.Flag("grep-v", "Drop lines matching the regular expression in line mode, can be repeated").PlaceHolder("REGEX").Strings()
+	outputURL        = kingpin.Flag("output-url", "Upload every connection as an object to the Go template of s3://bucket/key or gs://bucket/key instead of a local file").PlaceHolder("URL").String()
+	s3Endpoint       = kingpin.Flag("s3-endpoint", "Endpoint of the S3 API for --output-url, i.e. of a MinIO server").PlaceHolder("URL").String()
+	kafkaBrokers     = kingpin.Flag("kafka-brokers", "Publish every line in line mode as a message to the comma separated kafka brokers instead of a local file").PlaceHolder("HOST:PORT").String()
+	kafkaTopic       = kingpin.Flag("kafka-topic", "Go template of the topic of --kafka-brokers, i.e. 'logs-{{.Ip}}'").PlaceHolder("TEMPLATE").String()
+	natsURL          = kingpin.Flag("nats", "Publish every line in line mode as a message to the NATS server instead of a local file").PlaceHolder("URL").String()
+	natsSubject      = kingpin.Flag("nats-subject", "Go template of the subject of --nats, i.e. 'logs.{{.Ip}}'").PlaceHolder("TEMPLATE").String()
+	listenFd         = kingpin.Flag("fd", "Accept on the inherited listening descriptor instead of the address, can be repeated, systemd socket activation is detected by LISTEN_FDS").PlaceHolder("N").Ints()
+	configFile       = kingpin.Flag("config", "Read options from the YAML file of long flag names, address and file, reloaded on SIGHUP").PlaceHolder("FILE").String()
+	ackErrorText     = kingpin.Flag("ack-error", "Reply the Go template to the sender when its data could not be received or written, i.e. 'ERR {{.Error}}{{\"\\n\"}}'").PlaceHolder("TEMPLATE").String()
+	ackSync          = kingpin.Flag("ack-sync", "Sync the output file to disk before replying --ack").Bool()
+	minFreeSpace     = kingpin.Flag("min-free-space", "Apply --disk-full-policy once the file system of an output file has less than the bytes left").PlaceHolder("BYTES").Bytes()
+	diskFullPolicy   = kingpin.Flag("disk-full-policy", "What to do below --min-free-space: reject connections and fail writes, drop the data or spill-to-dir new output files").Default("reject").Enum("reject", "drop", "spill-to-dir")
+	spillDir         = kingpin.Flag("spill-dir", "Directory on another disk for new output files of --disk-full-policy spill-to-dir").PlaceHolder("DIR").String()
+	syslogMode       = kingpin.Flag("syslog", "Receive syslog messages, octet counted or one per line, with {{.Host}}, {{.App}}, {{.Facility}}, {{.Severity}} and {{.MsgTime}} of each in the output file name").Bool()
+	asyncWrites      = kingpin.Flag("async-writes", "Write every output file from a goroutine of its own, connections only wait for the disk once --disk-buffer is full").Bool()
+	asyncWriteSize   = kingpin.Flag("async-write-size", "Largest write of --async-writes, taking together the data queued meanwhile").Default("256KB").Bytes()
+	encryptKeys      = kingpin.Flag("encrypt-recipient", "Encrypt the output files to the age public key as '<name>.age', can be repeated").PlaceHolder("KEY").Strings()
+	passphrase       = kingpin.Flag("encrypt-passphrase", "Encrypt the output files with the passphrase instead of --encrypt-recipient").Envar("RECV_ENCRYPT_PASSPHRASE").PlaceHolder("PASSPHRASE").String()
+	onConflict       = kingpin.Flag("on-conflict", "What to do when an output file exists already: overwrite, append to it, skip the connection or number the name as '<name>.1'").Default("overwrite").Enum("overwrite", "append", "skip", "number")
+	statsInterval    = kingpin.Flag("stats", "Log the bytes received, throughput and elapsed time of every open connection at the interval, also served as JSON on /stats of --metrics-addr").PlaceHolder("DURATION").Duration()
+	statsFile        = kingpin.Flag("stats-file", "Write a JSON summary of the connections by sender to the file on exit").PlaceHolder("FILE").String()
+	reusePort        = kingpin.Flag("reuseport", "Set SO_REUSEPORT on the sockets listened on, so that several processes share the load of a port").Bool()
+	recvBuffer       = kingpin.Flag("recv-buffer", "Size of the kernel receive buffer SO_RCVBUF of the sockets listened on, against dropped udp datagrams").PlaceHolder("BYTES").Bytes()
+	keepAlive        = kingpin.Flag("keepalive", "Keep-alive period of accepted tcp connections, 15s by default, negative to disable").PlaceHolder("DURATION").Duration()
+	ipVersion        = kingpin.Flag("ip-version", "Listen on IPv4 only, IPv6 only or dual on both for addresses without a host: 4, 6 or dual").Default("dual").Enum("4", "6", "dual")
+	flushBytes       = kingpin.Flag("flush-bytes", "Flush --buffered output as well once the bytes are held back for a file, before --flush-interval").PlaceHolder("BYTES").Bytes()
+	gzipIndex        = kingpin.Flag("gzip-index", "End the gzip member on every flush of --compress-output gzip and list the members in '<name>.gzi' for random access").Bool()
+	readGzip         = kingpin.Flag("read-gzip", "Write the data of a file written with --gzip-index to stdout and exit, from --read-offset on").PlaceHolder("FILE").String()
+	readOffset       = kingpin.Flag("read-offset", "Uncompressed offset at which --read-gzip starts, found through the '<name>.gzi' index").PlaceHolder("OFFSET").Int64()
+	gzipReproducible = kingpin.Flag("gzip-reproducible", "Leave the time and system out of the gzip header of --compress-output gzip, also of --tar-output, so that the same data gives the same bytes").Bool()
+	maxExec          = kingpin.Flag("max-exec", "Run at most the number of --exec commands at a time, further connections wait for one to exit, at most for --queue-timeout").PlaceHolder("N").Int()
+)
+
+var (
+	handleMutex  sync.Locker
+	fileMap      map[string]*outputFile
+	id           int64
+	tcpListeners []net.Listener
+	listenFds    []int
+	udpListeners []net.PacketConn
+	distinctIps  map[string]struct{}
+
+	statsd            *statsdClient
+	logTemplate       *template.Template
+	wsBroadcast       *wsHub
+	upstreams         forwarders
+	udpBufferPool     *bufferPool
+	chunkBufferPool   = newBufferPool(64 * 1024)
+	fileMapMutex      sync.Mutex
+	distinctIpsMutex  sync.Mutex
+	distinctIpsWarned bool
+	requireMagic      []byte
+	inflight          sync.WaitGroup
+	shuttingDown      int32
+	handled           int64
+	totalConns        int64
+	totalBytes        int64
+	totalLines        int64
+	connSlots         chan struct{}
+	connQueue         chan struct{}
+	allowedNets       []*net.IPNet
+	deniedNets        []*net.IPNet
+	refused           int64
+	queueTimeouts     int64
+	rejectedIps       int64
+	prefixTemplate    *template.Template
+	delimiter         = byte('\n')
+	ackTemplate       *template.Template
+	ackErrorTemplate  *template.Template
+	grepPatterns      []*regexp.Regexp
+	grepVPatterns     []*regexp.Regexp
+)
+
+type templateBinding struct {
+	Ip   string
+	Port int
+	Id   int64
+	Key  string
+	Date string
+	Time string
+
+	Timestamp string
+	LocalPort int
+	CN        string
+	Pid       int
+	Uid       int
+	Now       time.Time
+	Hostname  string
+	Seq       int64
+	Proto     string
+
+	// of the request with --http
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+
+	// of the message with --syslog
+	Host     string
+	App      string
+	Facility string
+	Severity string
+	MsgTime  time.Time
+}
+
+func newTemplateBinding(id int64, ip string, port, localPort int, key string, now time.Time) *templateBinding {
+	return &templateBinding{
+		Id:   id,
+		Ip:   ip,
+		Port: port,
+		Key:  key,
+		Date: now.Format("2006-01-02"),
+		Time: now.Format("150405"),
+
+		Timestamp: now.Format(time.RFC3339Nano),
+		LocalPort: localPort,
+		Pid:       -1,
+		Uid:       -1,
+		Now:       now,
+		Hostname:  hostname,
+		Seq:       1,
+		Proto:     "tcp",
+	}
+}
+
+var (
+	hostname, _ = os.Hostname()
+
+	templateFuncs = template.FuncMap{
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		// the string is the last argument so that it can be piped
+		"replace": func(old, new, s string) string {
+			return strings.ReplaceAll(s, old, new)
+		},
+		"sanitize":   sanitizeKey,
+		"shellquote": shellquote,
+	}
+)
+
+func connBinding(info *connInfo, key string) *templateBinding {
+	binding := newTemplateBinding(info.Id, info.Ip, info.Port, remotePort(info.local), key, time.Now())
+	binding.CN = info.CN
+	binding.Pid = info.Pid
+	binding.Uid = info.Uid
+	binding.Seq = info.Seq
+	if info.addr != nil {
+		binding.Proto = info.addr.Network()
+	}
+	if info.quic {
+		binding.Proto = "quic"
+	}
+	if r := info.request; r != nil {
+		binding.Proto = "http"
+		if websocket.IsWebSocketUpgrade(r) {
+			binding.Proto = "ws"
+		}
+		if r.TLS != nil {
+			binding.Proto += "s"
+		}
+		binding.Method = r.Method
+		binding.Path = uploadPath(r)
+		binding.Query = r.URL.Query()
+		binding.Header = r.Header
+	}
+	if m := info.syslog; m != nil {
+		binding.Host, binding.App, binding.Facility, binding.Severity, binding.MsgTime = m.host, m.app, m.facility, m.severity, m.time
+	}
+	return binding
+}
+
+// connInfo follows a single connection or datagram, its exported fields are
+// available to --log-template.
+type connInfo struct {
+	Event    string
+	Ip       string
+	Port     int
+	Id       int64
+	Bytes    int64
+	Lines    int64
+	Rejected int64
+	Duration time.Duration
+	Error    string
+	CN       string
+	Pid      int
+	Uid      int
+	Seq      int64
+
+	// by --rate, --per-ip-rate or --max-rate, and by --max-bytes-per-conn
+	Throttled bool
+	Truncated bool
+
+	addr    net.Addr
+	local   net.Addr
+	request *http.Request
+	start   time.Time
+	idle    *idleSyncer
+	wal     *walEntry
+	digest  *streamDigest
+	output  *outputFile
+	quic    bool
+	syslog  *syslogMessage
+}
+
+func newConnInfo(addr net.Addr, id int64) *connInfo {
+	ip := remoteIPString(addr)
+	peerSeqMutex.Lock()
+	peerSeq[ip]++
+	seq := peerSeq[ip]
+	peerSeqMutex.Unlock()
+	return &connInfo{
+		Ip:    ip,
+		Port:  remotePort(addr),
+		Id:    id,
+		Pid:   -1,
+		Uid:   -1,
+		Seq:   seq,
+		addr:  addr,
+		start: time.Now(),
+	}
+}
+
+// connections counted by sender ip for {{.Seq}}
+var (
+	peerSeq      = make(map[string]int64)
+	peerSeqMutex sync.Mutex
 )
 
-var (
-	handleMutex sync.Locker
-	fileMap     map[string]*os.File
-	id          int64
-	tcpListener net.Listener
-	udpListener net.PacketConn
-)
+const maxLineLength = int(^uint(0)>>1) / 2
+
+// the first line of --first-line-key names the output file, do not buffer a
+// whole stream looking for it
+const maxFirstLineLen = 64 * 1024
+
+type fakeLocker struct{}
+
+func (*fakeLocker) Lock()   {}
+func (*fakeLocker) Unlock() {}
+
+func main() {
+	// report EPIPE on closed stdout as a write error instead of being killed,
+	// unlike signal.Ignore this is not inherited by the --exec commands
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
+
+	kingpin.CommandLine.HelpFlag.Short('h')
+	kingpin.Version("1.0")
+	var err error
+	args := os.Args[1:]
+	if path := configPath(args); path != "" {
+		if config, err = readConfig(path); err == nil {
+			var options []string
+			options, err = configArgs(config)
+			args = append(options, args...)
+		}
+		if err != nil {
+			kingpin.Fatalf("%s", err)
+		}
+	}
+	_, err = kingpin.CommandLine.Parse(args)
+	if err != nil {
+		kingpin.CommandLine.FatalUsage("%s\n", err)
+	}
+	if *readGzip != "" {
+		if err = readGzipAt(*readGzip, *readOffset); err != nil {
+			exit(err)
+		}
+		os.Exit(0)
+	}
+	if listenFds, err = inheritedFds(); err != nil {
+		exit(err)
+	}
+	// RECV_ADDR and RECV_FILE are read here rather than by kingpin, which
+	// would take a single argument for the address
+	envAddr := os.Getenv("RECV_ADDR")
+	configAddr := configValue(config, "address")
+	if len(listenFds) > 0 || envAddr != "" || configAddr != "" {
+		// the only argument is the output file then
+		if *file == "" {
+			*file, *addr = *addr, ""
+		}
+		if *addr != "" && len(listenFds) > 0 {
+			exit("no address can be given with --fd or socket activation")
+		}
+	}
+	if *file == "" {
+		*file = os.Getenv("RECV_FILE")
+	}
+	if *file == "" && config["file"] != nil {
+		*file, fileFromConfig = configValue(config, "file"), true
+	}
+	if *addr == "" && envAddr != "" && len(listenFds) == 0 {
+		*addr = envAddr
+	}
+	if *addr == "" && configAddr != "" && len(listenFds) == 0 {
+		*addr, addrFromConfig = configAddr, true
+	}
+	if len(listenFds) == 0 && *addr == "" {
+		kingpin.CommandLine.FatalUsage("required argument '[host]:port' not provided\n")
+	}
+	if *udpReaders < 1 {
+		kingpin.CommandLine.FatalUsage("--udp-readers must be at least 1\n")
+	}
+
+	if *logFileName != "" {
+		if err = openLogFile(*logFileName); err != nil {
+			exit(err)
+		}
+	}
+
+	if *unixDgram {
+		if *udp || *unixSocket {
+			exit("--unix-dgram can not be used with --udp or --unix")
+		}
+		*udp = true
+		*unixSocket = true
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			exit("--tls-cert and --tls-key must be given together")
+		}
+		if *udp {
+			exit("--tls-cert can not be used with --udp")
+		}
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			exit(err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if *tlsClientCa != "" {
+			pem, err := os.ReadFile(*tlsClientCa)
+			if err != nil {
+				exit(err)
+			}
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+				exit("no certificate found in --tls-client-ca")
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if *tlsClientCa != "" {
+		exit("--tls-client-ca requires --tls-cert")
+	}
+
+	if allowedNets, err = parseNets("--allow", *allow); err != nil {
+		exit(err)
+	}
+	if deniedNets, err = parseNets("--deny", *deny); err != nil {
+		exit(err)
+	}
+	if len(allowedNets)+len(deniedNets) > 0 && *unixSocket {
+		exit("--allow and --deny can not be used with --unix")
+	}
+	if *proxyProtocol && (*udp || *unixSocket) {
+		exit("--proxy-protocol can only be used with tcp")
+	}
+	if (*httpMode || *wsMode) && *udp {
+		exit("--http and --ws can not be used with --udp")
+	}
+	if *header {
+		if *udp || *httpMode || *wsMode || *firstLineKey {
+			exit("--header can not be used with --udp, --http, --ws or --first-line-key")
+		}
+		if !*hybrid {
+			*chunk = true
+		}
+	}
+	if *quicMode {
+		if tlsConfig == nil {
+			exit("--quic requires --tls-cert")
+		}
+		if *udp || *unixSocket || *httpMode || *wsMode || *proxyProtocol {
+			exit("--quic can not be used with --udp, --unix, --http, --ws or --proxy-protocol")
+		}
+	}
+	if strings.Contains(*addr, "://") && (*unixSocket || *quicMode) {
+		exit("tcp:// and udp:// addresses can not be used with --unix, --unix-dgram or --quic")
+	}
+	if *multicastGroup != "" && (!*udp && !strings.Contains(*addr, "udp://") || *unixDgram) {
+		exit("--multicast-group requires --udp")
+	}
+	if *multicastIface != "" && *multicastGroup == "" {
+		exit("--interface requires --multicast-group")
+	}
+	if *udp && *unixSocket && !*unixDgram {
+		exit("--unix can not be used with --udp")
+	}
+	if *multicastGroup != "" && len(listenFds) > 0 {
+		exit("--multicast-group can not be used with --fd or socket activation")
+	}
+	if (*reusePort || *ipVersion != "dual") && *unixSocket {
+		exit("--reuseport and --ip-version can not be used with --unix or --unix-dgram")
+	}
+	if *keepAlive != 0 && (*udp || *unixSocket || *quicMode) {
+		exit("--keepalive can only be used with tcp")
+	}
+	for _, fd := range listenFds {
+		if err = listenInherited(fd, tlsConfig); err != nil {
+			exit(err)
+		}
+	}
+	if len(listenFds) == 0 {
+		for _, address := range strings.Split(*addr, ",") {
+			if err = listen(address, tlsConfig); err != nil {
+				exit(err)
+			}
+		}
+	}
+
+	if *mutex {
+		handleMutex = &sync.Mutex{}
+	} else {
+		handleMutex = &fakeLocker{}
+	}
+
+	fileMap = make(map[string]*outputFile, 1)
+	if *maxOpenFiles > 0 || *fileIdleTimeout > 0 {
+		openFiles = newOpenFileList(*maxOpenFiles, *fileIdleTimeout)
+	}
+	if *maxConn > 0 {
+		connSlots = make(chan struct{}, *maxConn)
+	}
+	if *queueSize > 0 {
+		if connSlots == nil {
+			exit("--queue-size requires --max-conn")
+		}
+		connQueue = make(chan struct{}, *queueSize)
+	}
+	udpBufferPool = newBufferPool(int(*bufSize))
+	if *maxDistinctIps > 0 {
+		distinctIps = make(map[string]struct{})
+	}
+
+	if *statsdAddr != "" {
+		statsd, err = newStatsdClient(*statsdAddr, *statsdPrefix)
+		if err != nil {
+			exit(err)
+		}
+	}
+
+	if *file != "" {
+		fileTemplate, err = checkTemplate("fileName", *file)
+		if err != nil {
+			exit(err)
+		}
+	}
+	if *execText != "" {
+		if *file != "" || *tarOutputName != "" || *walDir != "" {
+			exit("--exec can not be used with an output file, --tar-output or --wal")
+		}
+		if execTemplate, err = checkCommandTemplate(*execText); err != nil {
+			exit(err)
+		}
+		if *maxExec > 0 {
+			execSlots = make(chan struct{}, *maxExec)
+		}
+	}
+	if *maxExec > 0 && *execText == "" {
+		exit("--max-exec requires --exec")
+	}
+	if *outputURL != "" {
+		if *file != "" || *execText != "" || *tarOutputName != "" || *walDir != "" || *atomicOutput {
+			exit("--output-url can not be used with an output file, --exec, --tar-output, --wal or --atomic")
+		}
+		if outputURLTemplate, err = checkOutputURL(*outputURL); err != nil {
+			exit(err)
+		}
+	}
+	if *kafkaBrokers != "" || *kafkaTopic != "" || *natsURL != "" || *natsSubject != "" {
+		if (*kafkaBrokers == "") != (*kafkaTopic == "") || (*natsURL == "") != (*natsSubject == "") {
+			exit("--kafka-brokers requires --kafka-topic, --nats requires --nats-subject and the other way around")
+		}
+		if *kafkaBrokers != "" && *natsURL != "" {
+			exit("--kafka-brokers can not be used with --nats")
+		}
+		if *chunk || *hybrid {
+			exit("--kafka-brokers and --nats can only be used in line mode")
+		}
+		if *file != "" || *execText != "" || *outputURL != "" || *tarOutputName != "" || *walDir != "" || *atomicOutput {
+			exit("--kafka-brokers and --nats can not be used with an output file, --exec, --output-url, --tar-output, --wal or --atomic")
+		}
+		if err = startPublisher(); err != nil {
+			exit(err)
+		}
+	}
+	if *wsAddr != "" {
+		wsBroadcast, err = newWsHub(*wsAddr)
+		if err != nil {
+			exit(err)
+		}
+	}
+	if *metricsAddr != "" {
+		if err = serveMetrics(*metricsAddr); err != nil {
+			exit(err)
+		}
+	}
+	for _, target := range *forward {
+		f, err := newForwarder(target)
+		if err != nil {
+			exit(err)
+		}
+		upstreams = append(upstreams, f)
+	}
+	if *tailAddr != "" {
+		if err = serveTail(*tailAddr, *maxTailers); err != nil {
+			exit(err)
+		}
+	}
+	if *delimiterText != "" {
+		if delimiter, err = parseDelimiter(*delimiterText); err != nil {
+			exit(err)
+		}
+	}
+	if *syslogMode {
+		if *chunk || *hybrid || *hexDump || *header || *firstLineKey || *frameText != "" || *delimiterText != "" {
+			exit("--syslog can not be used with --chunk, --hybrid, --hex, --header, --first-line-key, --frame or --delimiter")
+		}
+		if *execText != "" || *outputURL != "" || *kafkaTopic != "" || *natsSubject != "" || *tarOutputName != "" || *walDir != "" || *atomicOutput {
+			exit("--syslog can not be used with --exec, --output-url, --kafka-brokers, --nats, --tar-output, --wal or --atomic")
+		}
+	}
+	if *frameText != "" {
+		if *delimiterText != "" || *chunk || *hybrid || *hexDump || *header || *onLongLine != "close" {
+			exit("--frame can not be used with --delimiter, --chunk, --hybrid, --hex, --header or --on-long-line")
+		}
+		if framing, err = parseFrame(*frameText); err != nil {
+			exit(err)
+		}
+	}
+	if *hexDump {
+		if *prefix != "" {
+			exit("--hex can not be used with --prefix")
+		}
+		if !*hybrid {
+			*chunk = true
+		}
+	}
+	if grepPatterns, err = compilePatterns("--grep", *grep); err != nil {
+		exit(err)
+	}
+	if grepVPatterns, err = compilePatterns("--grep-v", *grepV); err != nil {
+		exit(err)
+	}
+	if *prefix != "" {
+		if prefixTemplate, err = checkTemplate("prefix", *prefix); err != nil {
+			exit(err)
+		}
+	}
+	if *atomicOutput && (*app || *dailyAppend || *maxSize > 0 || *rotateInterval > 0 || *diskRate > 0 || *tarOutputName != "" || *execText != "") {
+		exit("--atomic can not be used with --append, --daily-append, --max-size, --rotate-interval, --disk-rate, --tar-output or --exec")
+	}
+	if *onConflict == "append" {
+		*app = true
+	}
+	if *walDir != "" && !*app && !*dailyAppend {
+		exit("--wal requires --append or --daily-append, the replay would overwrite the outputs otherwise")
+	}
+	if (*onConflict == "skip" || *onConflict == "number") && (*app || *dailyAppend || *walDir != "") {
+		exit("--on-conflict skip or number can not be used with --append, --daily-append or --wal")
+	}
+	if *compressOutput != "none" && *mmapOutput {
+		exit("--compress-output can not be used with --mmap")
+	}
+	if *gzipReproducible && *compressOutput != "gzip" && (*tarOutputName == "" || tarCompression() != "gzip") {
+		exit("--gzip-reproducible requires --compress-output gzip or a .tar.gz --tar-output")
+	}
+	if *gzipIndex && (*compressOutput != "gzip" || len(*encryptKeys) > 0 || *passphrase != "" || *atomicOutput) {
+		exit("--gzip-index requires --compress-output gzip and can not be used with --encrypt-recipient or --atomic")
+	}
+	if len(*encryptKeys) > 0 || *passphrase != "" {
+		if *app || *dailyAppend || *mmapOutput || *walDir != "" {
+			exit("--encrypt-recipient can not be used with --append, --daily-append, --mmap or --wal")
+		}
+		if *execText != "" || *outputURL != "" || *kafkaTopic != "" || *natsSubject != "" || *tarOutputName != "" {
+			exit("--encrypt-recipient can not be used with --exec, --output-url, --kafka-brokers, --nats or --tar-output")
+		}
+		if err = setupEncryption(); err != nil {
+			exit(err)
+		}
+	}
+	if *flushBytes > 0 && !*buffered {
+		exit("--flush-bytes requires --buffered")
+	}
+	if *buffered {
+		stdoutFile.buffer = bufio.NewWriterSize(os.Stdout, int(*bufSize))
+		if *flushInterval > 0 {
+			go flushOutputFiles(*flushInterval)
+		}
+	}
+	if *ackText != "" {
+		if ackTemplate, err = checkAckTemplate(*ackText); err != nil {
+			exit(err)
+		}
+	}
+	if *ackErrorText != "" {
+		if ackErrorTemplate, err = checkAckTemplate(*ackErrorText); err != nil {
+			exit(err)
+		}
+	}
+	if *ackSync && *ackText == "" {
+		exit("--ack-sync requires --ack")
+	}
+	if *logTemplateText != "" {
+		if *logFormat == "json" {
+			exit("--log-template can not be used with --log-format json")
+		}
+		logTemplate, err = checkLogTemplate(*logTemplateText)
+		if err != nil {
+			exit(err)
+		}
+	}
+	if *jsonSchema != "" {
+		schema, err = jsonschema.Compile(*jsonSchema)
+		if err != nil {
+			exit(err)
+		}
+	}
+	if *requireMagicHex != "" {
+		requireMagic, err = hex.DecodeString(*requireMagicHex)
+		if err != nil {
+			exit("Invalid --require-magic:", err)
+		}
+	}
+	if *otelEndpoint != "" {
+		if err = setupOtel(*otelEndpoint); err != nil {
+			exit(err)
+		}
+	}
+	if *tarOutputName != "" {
+		if err = openTarOutput(*tarOutputName); err != nil {
+			exit(err)
+		}
+	}
+	if *perIpRate > 0 {
+		go evictIpLimiters()
+	}
+	if *statsInterval > 0 {
+		go reportProgress(*statsInterval)
+	}
+	if *maxRate > 0 {
+		globalLimiter = newRateLimiter(int(*maxRate))
+	}
+	if *controlPath != "" {
+		if control, err = openControlSocket(*controlPath); err != nil {
+			exit(err)
+		}
+	}
+	if *diskRate > 0 {
+		diskLimiter = newDiskLimiter(int(*diskRate))
+	}
+	if *recordsFileName != "" {
+		recordsFile, err = os.OpenFile(*recordsFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			exit(err)
+		}
+	}
+	if *manifestFile != "" {
+		if *checksum == "none" {
+			exit("--manifest requires --checksum")
+		}
+		if err = openManifest(*manifestFile); err != nil {
+			exit(err)
+		}
+	}
+	if *auditCsv != "" {
+		if err = openAuditCsv(*auditCsv); err != nil {
+			exit(err)
+		}
+	}
+	if *rejectFileName != "" {
+		rejectFile, err = openRejectFile(*rejectFileName)
+		if err != nil {
+			exit(err)
+		}
+	}
+	if *minFreeSpace > 0 {
+		if *diskFullPolicy == "spill-to-dir" && *spillDir == "" {
+			exit("--disk-full-policy spill-to-dir requires --spill-dir")
+		}
+		if diskSpace, err = newDiskGuard(uint64(*minFreeSpace)); err != nil {
+			exit(err)
+		}
+	} else if *spillDir != "" {
+		exit("--spill-dir requires --min-free-space")
+	}
+	if *emptyNamePolicy == "default-name" && *defaultName == "" {
+		exit("--empty-name-policy=default-name requires --default-name")
+	}
+	if *strictSingleFile {
+		if err = checkSingleFile(fileTemplate, *file); err != nil {
+			exit(err)
+		}
+	}
+	if *walDir != "" {
+		if err = os.MkdirAll(*walDir, 0755); err != nil {
+			exit(err)
+		}
+		if err = recoverWal(); err != nil {
+			exit(err)
+		}
+	}
+
+	go handleSignals()
+	if *configFile != "" {
+		go handleReload(tlsConfig)
+	}
+	listenerMutex.Lock()
+	startServing()
+	listenerMutex.Unlock()
+	servers.Wait()
+	inflight.Wait()
+	wsBroadcast.Close()
+	quit(0)
+}
+
+// acquireConnSlot blocks the accept loop while --max-conn connections are
+// being handled.
+func acquireConnSlot() {
+	if connSlots != nil {
+		connSlots <- struct{}{}
+	}
+}
+
+// acquireConnSlotWithin blocks the accept loop for a connection slot at most
+// for the timeout, 0 waits for one.
+func acquireConnSlotWithin(timeout time.Duration) bool {
+	if connSlots == nil || timeout <= 0 {
+		acquireConnSlot()
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case connSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		atomic.AddInt64(&queueTimeouts, 1)
+		return false
+	}
+}
+
+// queueConnSlot takes a connection slot, or with --queue-size a place in the
+// queue for one without blocking the accept loop. It reports false when the
+// queue is full or no slot got free within --queue-timeout, and whether the
+// connection has to waitConnSlot.
+func queueConnSlot() (queued, ok bool) {
+	if connQueue == nil {
+		return false, acquireConnSlotWithin(*queueTimeout)
+	}
+	select {
+	case connSlots <- struct{}{}:
+		return false, true
+	default:
+	}
+	select {
+	case connQueue <- struct{}{}:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// waitConnSlot waits in the queue for a connection slot, at most for
+// --queue-timeout.
+func waitConnSlot(queued bool) bool {
+	if !queued {
+		return true
+	}
+	defer func() { <-connQueue }()
+	var timeout <-chan time.Time
+	if *queueTimeout > 0 {
+		timer := time.NewTimer(*queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case connSlots <- struct{}{}:
+		return true
+	case <-timeout:
+		atomic.AddInt64(&queueTimeouts, 1)
+		return false
+	}
+}
+
+// logQueueFull logs why queueConnSlot refused a connection.
+func logQueueFull(addr net.Addr) {
+	if connQueue == nil {
+		log("Reject connection from %s, waited %s\n", addr, *queueTimeout)
+	} else {
+		log("Reject connection from %s, %d connections waiting already\n", addr, *queueSize)
+	}
+}
+
+func releaseConnSlot() {
+	if connSlots != nil {
+		<-connSlots
+	}
+}
+
+// listen opens a listener of the address, which is tcp unless --udp is given
+// or it starts with udp://, or tcp:// for the other way around.
+func listen(address string, tlsConfig *tls.Config) error {
+	key, isUdp := address, *udp
+	if rest, ok := strings.CutPrefix(address, "udp://"); ok {
+		address, isUdp = rest, true
+	} else if rest, ok := strings.CutPrefix(address, "tcp://"); ok {
+		address, isUdp = rest, false
+	}
+	if *unixSocket {
+		// remove a socket left behind by a previous run
+		if stat, err := os.Stat(address); err == nil && stat.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	if *quicMode {
+		udpConn, err := listenConfig().ListenPacket(context.Background(), ipNetwork("udp"), address)
+		if err != nil {
+			return err
+		}
+		l, err := listenQuic(udpConn, tlsConfig)
+		if err != nil {
+			return err
+		}
+		addressListeners[key] = l
+		return nil
+	}
+	if isUdp {
+		network := ipNetwork("udp")
+		if *unixDgram {
+			network = "unixgram"
+		}
+		var l net.PacketConn
+		var err error
+		if *multicastGroup != "" {
+			l, err = listenMulticast(address)
+		} else {
+			l, err = listenConfig().ListenPacket(context.Background(), network, address)
+		}
+		if err != nil {
+			return err
+		}
+		udpListeners = append(udpListeners, l)
+		addressListeners[key] = l
+		return nil
+	}
+	network := ipNetwork("tcp")
+	if *unixSocket {
+		network = "unix"
+	}
+	// closing a unix listener unlinks the socket file
+	l, err := listenConfig().Listen(context.Background(), network, address)
+	if err != nil {
+		return err
+	}
+	addressListeners[key] = addListener(l, tlsConfig)
+	return nil
+}
+
+func addListener(l net.Listener, tlsConfig *tls.Config) net.Listener {
+	if *proxyProtocol {
+		l = &proxyListener{l}
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	tcpListeners = append(tcpListeners, l)
+	return l
+}
+
+// listenMulticast joins --multicast-group on the port of address, the host of
+// address is not used.
+func listenMulticast(address string) (net.PacketConn, error) {
+	group := net.ParseIP(*multicastGroup)
+	if group == nil || !group.IsMulticast() {
+		return nil, fmt.Errorf("invalid --multicast-group %q", *multicastGroup)
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	var iface *net.Interface
+	if *multicastIface != "" {
+		if iface, err = net.InterfaceByName(*multicastIface); err != nil {
+			return nil, fmt.Errorf("--interface %s: %w", *multicastIface, err)
+		}
+	}
+	l, err := net.ListenMulticastUDP("udp", iface, &net.UDPAddr{IP: group, Port: portNum})
+	if err != nil {
+		return nil, err
+	}
+	if *recvBuffer > 0 {
+		if err = l.SetReadBuffer(int(*recvBuffer)); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+var (
+	servers sync.WaitGroup
+	served  = make(map[io.Closer]bool)
+)
+
+// startServing serves the listeners not served yet, with listenerMutex held.
+func startServing() {
+	for _, l := range udpListeners {
+		if served[l] {
+			continue
+		}
+		served[l] = true
+		log("Listening on %s\n", l.LocalAddr())
+		servers.Add(1)
+		go func(l net.PacketConn) {
+			defer servers.Done()
+			serveUdp(l)
+		}(l)
+	}
+	for _, l := range tcpListeners {
+		if served[l] {
+			continue
+		}
+		served[l] = true
+		log("Listening on %s\n", l.Addr())
+		servers.Add(1)
+		go func(l net.Listener) {
+			defer servers.Done()
+			if *httpMode || *wsMode {
+				serveHttp(l)
+			} else {
+				serveTcp(l)
+			}
+		}(l)
+	}
+	for _, l := range quicListeners {
+		if served[l] {
+			continue
+		}
+		served[l] = true
+		log("Listening on %s\n", l.Addr())
+		servers.Add(1)
+		go func(l *quic.Listener) {
+			defer servers.Done()
+			serveQuic(l)
+		}(l)
+	}
+}
+
+// removeListener forgets a listener closed by a reload, with listenerMutex
+// held.
+func removeListener(l io.Closer) {
+	delete(served, l)
+	for i, u := range udpListeners {
+		if u == l {
+			udpListeners = append(udpListeners[:i], udpListeners[i+1:]...)
+			return
+		}
+	}
+	for i, t := range tcpListeners {
+		if t == l {
+			tcpListeners = append(tcpListeners[:i], tcpListeners[i+1:]...)
+			return
+		}
+	}
+	for i, q := range quicListeners {
+		if q == l {
+			quicListeners = append(quicListeners[:i], quicListeners[i+1:]...)
+			return
+		}
+	}
+}
+
+func stopListening() {
+	atomic.StoreInt32(&shuttingDown, 1)
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+	for _, l := range udpListeners {
+		l.Close()
+	}
+	for _, l := range tcpListeners {
+		l.Close()
+	}
+	for _, l := range quicListeners {
+		l.Close()
+	}
+}
+
+// takeCount reports whether one more connection may be handled under
+// --count, and stops listening once it is the last one.
+func takeCount() bool {
+	if *count <= 0 {
+		return true
+	}
+	n := atomic.AddInt64(&handled, 1)
+	if n == *count {
+		stopListening()
+	}
+	return n <= *count
+}
+
+// handleSignals stops accepting on the first SIGINT or SIGTERM, so that main
+// finishes the connections in flight and exits; the second one exits at once.
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	log("Shutting down, waiting for connections to finish\n")
+	stopListening()
+	var drain <-chan time.Time
+	if *drainTimeout > 0 {
+		drain = time.After(*drainTimeout)
+	}
+	select {
+	case <-signals:
+		warn("Forced exit\n")
+	case <-drain:
+		warn("Connections not finished within %s, exit\n", *drainTimeout)
+	}
+	quit(1)
+}
+
+func logSummary() {
+	ips := ""
+	if distinctIps != nil {
+		distinctIpsMutex.Lock()
+		ips = fmt.Sprintf(" from %d distinct IPs", len(distinctIps))
+		distinctIpsMutex.Unlock()
+	}
+	others := ""
+	if *rejectNewIps {
+		others += fmt.Sprintf(", %d by --reject-new-ips", atomic.LoadInt64(&rejectedIps))
+	}
+	if *queueTimeout > 0 {
+		others += fmt.Sprintf(", %d after --queue-timeout", atomic.LoadInt64(&queueTimeouts))
+	}
+	warn("Received %d connections%s, %d bytes, %d lines, refused %d by --allow or --deny%s\n",
+		atomic.LoadInt64(&totalConns), ips, atomic.LoadInt64(&totalBytes), atomic.LoadInt64(&totalLines), atomic.LoadInt64(&refused), others)
+}
+
+func checkTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := bytes.NewBuffer([]byte{})
+	err = t.Execute(buffer, newTemplateBinding(1, "127.0.0.1", 8080, 8080, "key", time.Now()))
+	return t, err
+}
+
+func checkSingleFile(t *template.Template, text string) error {
+	if t == nil {
+		return fmt.Errorf("--strict-single-file requires an output file")
+	}
+	names := make([]string, 2)
+	for i := range names {
+		buffer := bytes.NewBuffer([]byte{})
+		// a day and an hour apart, so that {{.Date}} and {{.Time}} both change
+		now := time.Now().Add(time.Duration(i) * 25 * time.Hour)
+		localPort := 8080
+		if len(tcpListeners)+len(udpListeners) > 1 {
+			localPort += i
+		}
+		binding := newTemplateBinding(int64(i+1), fmt.Sprintf("127.0.0.%d", i+1), 8080+i, localPort, fmt.Sprintf("key%d", i+1), now)
+		binding.Seq = int64(i + 1)
+		err := t.Execute(buffer, binding)
+		if err != nil {
+			return err
+		}
+		names[i] = buffer.String()
+	}
+	if names[0] != names[1] {
+		return fmt.Errorf("--strict-single-file: output file '%s' depends on per-connection fields", text)
+	}
+	return nil
+}
+
+func serveUdp(l net.PacketConn) {
+	var readers sync.WaitGroup
+	for i := 0; i < *udpReaders; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			readUdp(l)
+		}()
+	}
+	readers.Wait()
+}
+
+func readUdp(l net.PacketConn) {
+	var data *[]byte
+	for {
+		if data == nil {
+			data = udpBufferPool.Get()
+		}
+		n, addr, err := l.ReadFrom(*data)
+		if err != nil {
+			if atomic.LoadInt32(&shuttingDown) == 1 || listenerRemoved(l) {
+				return
+			}
+			exit(err)
+		}
+		t := currentFileTemplate()
+		if a, ok := addr.(*net.UnixAddr); addr == nil || ok && a == nil {
+			// the sender on a unix datagram socket is not bound to a path
+			addr = &net.UnixAddr{Name: "@", Net: "unixgram"}
+		}
+		if n == 0 && *ignoreEmpty {
+			log("Drop empty datagram from %s\n", addr)
+			continue
+		}
+		if !checkAllowed(addr) {
+			log("Drop data from %s, not allowed\n", addr)
+			continue
+		}
+		if !checkDistinctIp(addr) {
+			log("Drop data from %s\n", addr)
+			continue
+		}
+		if *udpIdleTimeout > 0 {
+			if !dispatchDatagram(t, l, addr, data, n) {
+				return
+			}
+			data = nil
+			continue
+		}
+		if !takeCount() {
+			return
+		}
+		connId := atomic.AddInt64(&id, 1)
+		info := newConnInfo(addr, connId)
+		info.local = l.LocalAddr()
+
+		var outputFile *outputFile
+		if !*firstLineKey {
+			if outputFile = getOutputFile(t, info, ""); outputFile == nil {
+				continue
+			}
+		}
+
+		buf := data
+		data = nil
+
+		acquireConnSlot()
+		inflight.Add(1)
+		go func() {
+			handleMutex.Lock()
+			defer func() {
+				handleMutex.Unlock()
+				udpBufferPool.Put(buf, n)
+				releaseConnSlot()
+				inflight.Done()
+			}()
+
+			handleUdp(bytes.NewBuffer((*buf)[:n]), t, l, info, outputFile)
+		}()
+	}
+}
+
+// handleUdp handles the data of a datagram, or of a session of them with
+// --udp-idle-timeout.
+func handleUdp(reader io.Reader, t *template.Template, l net.PacketConn, info *connInfo, outputFile *outputFile) {
+	if *firstLineKey {
+		if reader, outputFile = routeByFirstLine(reader, t, info); outputFile == nil {
+			return
+		}
+	}
+	handleRequest(reader, info, outputFile)
+	if reply := ackReply(info); reply != nil {
+		if _, err := l.WriteTo(reply, info.addr); err != nil {
+			log("Write ack to %s error: %s\n", info.addr, err.Error())
+		}
+	}
+}
+
+func serveTcp(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&shuttingDown) == 1 || listenerRemoved(l) {
+				return
+			}
+			exit(err)
+		}
+		t := currentFileTemplate()
+		netConn := conn
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			netConn = tlsConn.NetConn()
+		}
+		if proxyConn, ok := netConn.(*proxyConn); ok {
+			// the header is read off the accept loop, so that a client
+			// sending nothing does not hold up the others
+			inflight.Add(1)
+			go func() {
+				defer inflight.Done()
+				if err := proxyConn.proxyError(); err != nil {
+					log("Read proxy protocol header from %s error: %s\n", proxyConn.Conn.RemoteAddr(), err.Error())
+					conn.Close()
+					return
+				}
+				acceptTcp(conn, proxyConn.Conn, t)
+			}()
+			continue
+		}
+		if !acceptTcp(conn, netConn, t) {
+			return
+		}
+	}
+}
+
+// acceptTcp starts handling an accepted connection, netConn is the one
+// underneath tls and the PROXY protocol. It returns false once --count is
+// reached.
+func acceptTcp(conn, netConn net.Conn, t *template.Template) bool {
+	tlsConn, isTls := conn.(*tls.Conn)
+	if !checkAllowed(conn.RemoteAddr()) {
+		log("Reject connection from %s, not allowed\n", conn.RemoteAddr())
+		conn.Close()
+		return true
+	}
+	if !checkDistinctIp(conn.RemoteAddr()) {
+		log("Reject connection from %s\n", conn.RemoteAddr())
+		conn.Close()
+		return true
+	}
+	if !takeCount() {
+		conn.Close()
+		return false
+	}
+	if tcpConn, ok := netConn.(*net.TCPConn); ok {
+		// Go disables Nagle's algorithm by default, keep the OS default instead
+		tcpConn.SetNoDelay(*noDelay)
+	}
+	connId := atomic.AddInt64(&id, 1)
+	info := newConnInfo(conn.RemoteAddr(), connId)
+	info.local = conn.LocalAddr()
+	if *unixSocket {
+		info.Pid, info.Uid = peerCred(conn)
+	}
+
+	// the name of a tls connection may depend on the client certificate,
+	// so it is only known after the handshake
+	var outputFile *outputFile
+	if !*firstLineKey && !*header && !isTls {
+		if outputFile = getOutputFile(t, info, ""); outputFile == nil {
+			conn.Close()
+			return true
+		}
+	}
+
+	queued, ok := queueConnSlot()
+	if !ok {
+		logQueueFull(conn.RemoteAddr())
+		conn.Close()
+		return true
+	}
+	inflight.Add(1)
+	go func() {
+		if !waitConnSlot(queued) {
+			log("Reject connection from %s, waited %s\n", conn.RemoteAddr(), *queueTimeout)
+			conn.Close()
+			inflight.Done()
+			return
+		}
+		handleMutex.Lock()
+		defer func() {
+			handleMutex.Unlock()
+			conn.Close()
+			releaseConnSlot()
+			inflight.Done()
+		}()
+
+		if isTls {
+			if !handshake(tlsConn, info) {
+				return
+			}
+			if !*firstLineKey && !*header {
+				if outputFile = getOutputFile(t, info, ""); outputFile == nil {
+					return
+				}
+			}
+		}
 
-type templateBinding struct {
-	Ip   string
-	Port int
-	Id   int64
+		handleConn(conn, t, info, outputFile)
+	}()
+	return true
 }
 
-const maxLineLength = int(^uint(0)>>1) / 2
-
-type fakeLocker struct{}
-
-func (*fakeLocker) Lock()   {}
-func (*fakeLocker) Unlock() {}
+// streamConn is a tcp connection, or a stream of --quic.
+type streamConn interface {
+	io.ReadWriter
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
 
-func main() {
-	kingpin.CommandLine.HelpFlag.Short('h')
-	kingpin.Version("1.0")
-	_, err := kingpin.CommandLine.Parse(os.Args[1:])
-	if err != nil {
-		kingpin.CommandLine.FatalUsage("%s\n", err)
+// handleConn reads the data of a connection into outputFile, which is opened
+// here with --first-line-key or --header, and replies the --ack.
+func handleConn(conn streamConn, t *template.Template, info *connInfo, outputFile *outputFile) {
+	var reader io.Reader = conn
+	if *timeout > 0 || *maxConnDuration > 0 {
+		reader = &deadlineReader{conn: conn, timeout: *timeout, start: time.Now()}
 	}
-
-	if *udp {
-		udpListener, err = net.ListenPacket("udp", *addr)
-		defer udpListener.Close()
-	} else {
-		tcpListener, err = net.Listen("tcp", *addr)
-		defer tcpListener.Close()
+	if *firstLineKey {
+		if reader, outputFile = routeByFirstLine(reader, t, info); outputFile == nil {
+			return
+		}
+	} else if *header {
+		if reader, outputFile = routeByHeader(reader, t, info); outputFile == nil {
+			return
+		}
 	}
-	if err != nil {
-		exit(err)
+	handleRequest(reader, info, outputFile)
+	if reply := ackReply(info); reply != nil {
+		if *timeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(*timeout))
+		}
+		if _, err := conn.Write(reply); err != nil {
+			log("Write ack to %s error: %s\n", info.addr, err.Error())
+		}
 	}
+}
 
-	if *mutex {
-		handleMutex = &sync.Mutex{}
-	} else {
-		handleMutex = &fakeLocker{}
+// handshake completes the tls handshake of conn and takes the common name of
+// the client certificate, if any.
+func handshake(conn *tls.Conn, info *connInfo) bool {
+	if *timeout > 0 {
+		conn.SetDeadline(time.Now().Add(*timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := conn.Handshake(); err != nil {
+		log("TLS handshake with %s error: %s\n", info.addr, err.Error())
+		return false
 	}
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		info.CN = certs[0].Subject.CommonName
+	}
+	return true
+}
 
-	fileMap = make(map[string]*os.File, 1)
+func remotePort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	return 0
+}
 
-	var t *template.Template
-	if *file != "" {
-		t, err = checkTemplate(*file)
-		if err != nil {
-			exit(err)
-		}
+// remoteIP is nil for addresses without one, i.e. of unix sockets.
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
 	}
+	return nil
+}
 
-	if *udp {
-		log("Listening on %s\n", udpListener.LocalAddr())
-		serveUdp(t)
-	} else {
-		log("Listening on %s\n", tcpListener.Addr())
-		serveTcp(t)
+func remoteIPString(addr net.Addr) string {
+	if ip := remoteIP(addr); ip != nil {
+		return ip.String()
 	}
+	return ""
 }
 
-func checkTemplate(fileName string) (*template.Template, error) {
-	t, err := template.New("fileName").Parse(fileName)
-	if err != nil {
-		return nil, err
+// checkAllowed reports whether data from addr passes --allow and --deny, and
+// counts the refused ones.
+func checkAllowed(addr net.Addr) bool {
+	if len(allowedNets) == 0 && len(deniedNets) == 0 {
+		return true
 	}
+	ip := remoteIP(addr)
+	if ip != nil && !containsIp(deniedNets, ip) && (len(allowedNets) == 0 || containsIp(allowedNets, ip)) {
+		return true
+	}
+	atomic.AddInt64(&refused, 1)
+	return false
+}
 
-	buffer := bytes.NewBuffer([]byte{})
-	err = t.Execute(buffer, &templateBinding{
-		Id:   1,
-		Ip:   "127.0.0.1",
-		Port: 8080,
-	})
-	return t, err
+func containsIp(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
-func serveUdp(t *template.Template) {
-	for {
-		data := make([]byte, *bufSize)
-		n, addr, err := udpListener.ReadFrom(data)
+// parseNets accepts CIDRs as well as single addresses.
+func parseNets(flag string, values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s address %q", flag, v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
 		if err != nil {
-			exit(err)
+			return nil, err
 		}
-		id++
-
-		outputFile := getOutputFile(t, err, addr)
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
 
-		go func() {
-			handleMutex.Lock()
-			defer func() {
-				handleMutex.Unlock()
-			}()
+// checkDistinctIp records the source IP of addr and reports whether data from
+// it should be accepted. A warning is printed once the number of distinct IPs
+// exceeds --max-distinct-ips, and with --reject-new-ips any further unseen IP
+// is refused. The IPs are only tracked with --max-distinct-ips.
+func checkDistinctIp(addr net.Addr) bool {
+	if distinctIps == nil {
+		return true
+	}
+	distinctIpsMutex.Lock()
+	defer distinctIpsMutex.Unlock()
 
-			log("Read data from %s\n", addr)
-			buf := make([]byte, n)
-			copy(buf, data)
-			reader := bytes.NewBuffer(buf)
-			handleRequest(reader, addr, outputFile)
-		}()
+	ip := remoteIPString(addr)
+	if _, ok := distinctIps[ip]; ok {
+		return true
+	}
+	if len(distinctIps) >= *maxDistinctIps {
+		if !distinctIpsWarned {
+			distinctIpsWarned = true
+			warn("Warning: number of distinct source IPs exceeds %d, new IP %s\n", *maxDistinctIps, ip)
+		}
+		if *rejectNewIps {
+			atomic.AddInt64(&rejectedIps, 1)
+			return false
+		}
 	}
+	distinctIps[ip] = struct{}{}
+	return true
 }
 
-func serveTcp(t *template.Template) {
+// routeByFirstLine consumes the first line of reader as the routing key and
+// opens the output file for it. Connections closed before a complete first
+// line, or with one longer than maxFirstLineLen, are discarded, in which case
+// the returned output file is nil.
+func routeByFirstLine(reader io.Reader, t *template.Template, info *connInfo) (io.Reader, *outputFile) {
+	bufReader := bufio.NewReader(reader)
+	var line []byte
 	for {
-		conn, err := tcpListener.Accept()
-		if err != nil {
-			exit(err)
+		part, err := bufReader.ReadSlice(delimiter)
+		line = append(line, part...)
+		if len(line) > maxFirstLineLen {
+			log("Discard connection %s, its first line key is longer than %d bytes\n", info.addr, maxFirstLineLen)
+			return nil, nil
 		}
-		id++
-
-		outputFile := getOutputFile(t, err, conn.RemoteAddr())
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			log("Discard connection %s without first line key: %s\n", info.addr, err.Error())
+			return nil, nil
+		}
+	}
+	key := sanitizeKey(string(bytes.TrimRight(line, "\r\n")))
+	return bufReader, getOutputFile(t, info, key)
+}
 
-		go func() {
-			handleMutex.Lock()
-			defer func() {
-				handleMutex.Unlock()
-				conn.Close()
-			}()
+func sanitizeKey(key string) string {
+	sanitized := []byte(key)
+	for i, c := range sanitized {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' && i > 0) {
+			sanitized[i] = '_'
+		}
+	}
+	if len(sanitized) == 0 {
+		return "_"
+	}
+	return string(sanitized)
+}
 
-			log("Read data from %s\n", conn.RemoteAddr())
-			//reader := bufio.NewReader(conn)
-			handleRequest(conn, conn.RemoteAddr(), outputFile)
-		}()
+// limitNameLength shortens the last element of a generated file name to max
+// bytes, replacing the overflow by a hash of the full name to keep names
+// distinct.
+func limitNameLength(fileName string, max int) string {
+	if *dailyAppend {
+		max -= len(".2006-01-02")
+	}
+	dir, base := filepath.Split(fileName)
+	if len(base) <= max {
+		return fileName
+	}
+	h := fnv.New32a()
+	h.Write([]byte(fileName))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+	cut := max - len(suffix)
+	if cut < 0 {
+		cut = 0
 	}
+	// do not split a multi-byte character
+	for cut > 0 && !utf8.RuneStart(base[cut]) {
+		cut--
+	}
+	shortened := dir + base[:cut] + suffix
+	log("Output file name %s is too long, shorten it to %s\n", fileName, shortened)
+	return shortened
 }
 
-func getOutputFile(t *template.Template, err error, addr net.Addr) *os.File {
-	fileName := *file
+// getOutputFile returns the output file for a connection, or nil when the
+// connection should be closed.
+func getOutputFile(t *template.Template, info *connInfo, key string) *outputFile {
+	if *syslogMode && info.syslog == nil {
+		return &outputFile{router: &syslogRouter{t: t, files: make(map[*outputFile]bool)}}
+	}
+	binding := connBinding(info, key)
+	if execTemplate != nil {
+		buffer := bytes.NewBuffer([]byte{})
+		if err := execTemplate.Execute(buffer, binding); err != nil {
+			exit(err)
+		}
+		c, err := startCommand(buffer.String())
+		if err != nil {
+			log("Start command for %s error: %s\n", info.addr, err.Error())
+			return nil
+		}
+		return &outputFile{name: c.line, command: c}
+	}
+	if outputURLTemplate != nil {
+		buffer := bytes.NewBuffer([]byte{})
+		if err := outputURLTemplate.Execute(buffer, binding); err != nil {
+			exit(err)
+		}
+		u, err := newUpload(buffer.String())
+		if err != nil {
+			log("Upload for %s error: %s\n", info.addr, err.Error())
+			return nil
+		}
+		return &outputFile{name: u.name, upload: u}
+	}
+	if topicTemplate != nil {
+		buffer := bytes.NewBuffer([]byte{})
+		if err := topicTemplate.Execute(buffer, binding); err != nil {
+			exit(err)
+		}
+		p := newPublisher(buffer.String(), info, binding)
+		return &outputFile{name: p.topic, publish: p}
+	}
+	var fileName string
 	if t != nil {
 		buffer := bytes.NewBuffer([]byte{})
-		var ip string
-		var port int
-		if *udp {
-			ip = addr.(*net.UDPAddr).IP.String()
-			port = addr.(*net.UDPAddr).Port
-		} else {
-			ip = addr.(*net.TCPAddr).IP.String()
-			port = addr.(*net.TCPAddr).Port
-		}
-		err = t.Execute(buffer, &templateBinding{
-			Id:   id,
-			Ip:   ip,
-			Port: port,
-		})
+		err := t.Execute(buffer, binding)
 		if err != nil {
 			exit(err)
 		}
 		fileName = buffer.String()
-		if fileName == *file {
-			t = nil
+		if fileName == "" {
+			switch *emptyNamePolicy {
+			case "error":
+				log("Output file name for %s is empty, close it\n", info.addr)
+				return nil
+			case "default-name":
+				fileName = *defaultName
+			}
 		}
 	}
-	outputFile := os.Stdout
-	if fileName != "" {
-		outputFile = openOutputFile(fileName)
+	if t == nil {
+		fileName = key
+	}
+	if fileName != "" && *maxNameLen > 0 {
+		fileName = limitNameLength(fileName, *maxNameLen)
+	}
+	if tarWriter != nil && fileName == "" {
+		fileName = strconv.FormatInt(info.Id, 10)
+	}
+	if tarWriter == nil && fileName != "" && diskSpace.low(filepath.Dir(fileName)) {
+		// with drop the file is opened, but nothing written to it
+		if *diskFullPolicy == "spill-to-dir" {
+			fileName = filepath.Join(*spillDir, fileName)
+		}
+		if *diskFullPolicy == "reject" || *diskFullPolicy == "spill-to-dir" && diskSpace.low(filepath.Dir(fileName)) {
+			log("Reject %s, %s\n", info.addr, errDiskFull.Error())
+			return nil
+		}
 	}
-	return outputFile
+	return outputFileByName(fileName)
 }
 
-func openOutputFile(fileName string) *os.File {
-	if file, ok := fileMap[fileName]; ok {
-		return file
+func outputFileByName(fileName string) *outputFile {
+	if tarWriter != nil {
+		// every connection becomes its own entry of the archive
+		return &outputFile{name: fileName, entry: &tarEntry{name: fileName}}
+	}
+	if fileName == "" {
+		return stdoutFile
 	}
+	if *atomicOutput {
+		return openPartFile(fileName)
+	}
+	return openOutputFile(fileName)
+}
 
-	mode := os.O_CREATE | os.O_WRONLY
-	if *app {
-		mode |= os.O_APPEND
+func parseDelimiter(text string) (byte, error) {
+	switch text {
+	case "\\0":
+		return 0, nil
+	case "\\n":
+		return '\n', nil
+	case "\\r":
+		return '\r', nil
+	case "\\t":
+		return '\t', nil
 	}
-	file, err := os.OpenFile(fileName, mode, 0644)
-	if err != nil {
-		exit(err)
+	if len(text) == 1 {
+		return text[0], nil
+	}
+	if len(text) == 4 && strings.HasPrefix(text, "\\x") {
+		if b, err := hex.DecodeString(text[2:]); err == nil {
+			return b[0], nil
+		}
 	}
-	fileMap[fileName] = file
-	return file
+	return 0, fmt.Errorf("invalid --delimiter %q, expect a single byte", text)
 }
 
 func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	if atEOF && len(data) == 0 {
 		return 0, nil, nil
 	}
-	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+	if i := bytes.IndexByte(data, delimiter); i >= 0 {
 		return i + 1, data[0 : i+1], nil
 	}
 	if atEOF {
@@ -218,64 +1778,520 @@ func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	return 0, nil, nil
 }
 
-func handleRequest(reader io.Reader, addr net.Addr, file *os.File) {
-	if *gz {
-		peekReader := bufio.NewReader(reader)
-		// ref: gunzip.readHeader
-		header, _ := peekReader.Peek(10)
-		_, e := gzip.NewReader(bytes.NewReader(header))
-		if e == nil {
-			reader, _ = gzip.NewReader(peekReader)
-		} else {
-			reader = peekReader
+func handleRequest(reader io.Reader, info *connInfo, file *outputFile) {
+	info.output = file
+	logConn(info, "open", "Read data from %s\n", info.addr)
+	statsd.Count("connections", 1)
+	span := startConnSpan(info)
+	atomic.AddInt64(&activeConns, 1)
+	defer func() {
+		// an ack is only due once the data left the queue
+		if (*buffered || ackTemplate != nil) && file.throttle != nil {
+			file.throttle.Flush()
+		}
+		if err := file.Flush(); err != nil {
+			log("Flush %s error: %s\n", file.label(), err.Error())
+		}
+		info.wal.commit(file)
+		if file.part {
+			file.finish(info)
+		}
+		atomic.AddInt64(&totalConns, 1)
+		atomic.AddInt64(&totalBytes, info.Bytes)
+		atomic.AddInt64(&totalLines, info.Lines)
+		atomic.AddInt64(&activeConns, -1)
+		countPeerBytes(info)
+		finishProgress(info)
+		endConnSpan(span, info)
+		auditConn(info, file)
+		writeManifest(info, file)
+		control.complete(info, file)
+		statsd.Count("bytes", info.Bytes)
+		if !*chunk {
+			statsd.Count("lines", info.Lines)
+			statsd.Count("lines.rejected", info.Rejected)
+		}
+		statsd.Timing("connection.duration", time.Since(info.start))
+	}()
+	if file.entry != nil {
+		defer func() {
+			if err := file.entry.commit(); err != nil {
+				log("Write tar entry %s error: %s\n", file.entry.name, err.Error())
+			}
+		}()
+	}
+	if file.command != nil {
+		defer file.command.wait(info)
+	}
+	if file.upload != nil {
+		defer func() {
+			if err := file.upload.commit(); err != nil {
+				info.Error = err.Error()
+				logConn(info, "error", "Upload %s error: %s\n", file.upload.name, err.Error())
+			}
+		}()
+	}
+	if file.publish != nil {
+		defer func() {
+			if err := file.publish.commit(); err != nil {
+				info.Error = err.Error()
+				logConn(info, "error", "Publish lines of %s error: %s\n", info.addr, err.Error())
+			}
+		}()
+	}
+	if *flushOnIdle > 0 {
+		info.idle = startIdleSyncer(file, *flushOnIdle)
+		defer info.idle.Stop()
+	}
+
+	if *statsInterval > 0 || *statsFile != "" {
+		reader = trackProgress(info, reader)
+	}
+	if info.wal == nil {
+		if *readRate > 0 {
+			reader = &rateReader{reader: reader, limiter: newRateLimiter(int(*readRate)), info: info}
+		}
+		if *perIpRate > 0 {
+			reader = newPerIpRateReader(reader, info)
+		}
+		if globalLimiter != nil {
+			reader = &rateReader{reader: reader, limiter: globalLimiter, info: info}
+		}
+		if *walDir != "" {
+			var err error
+			if info.wal, reader, err = captureWal(reader, info, file); err != nil {
+				warn("Warning: read %s without write ahead log: %s\n", info.addr, err.Error())
+			}
+		}
+	}
+	if len(requireMagic) > 0 {
+		var ok bool
+		if reader, ok = checkMagic(reader); !ok {
+			info.Error = "magic mismatch"
+			logConn(info, "error", "Connection %s does not start with the magic bytes, drop it\n", info.addr)
+			return
+		}
+	}
+	if *compress != "none" || *gz {
+		var err error
+		if reader, err = decompressReader(reader); err != nil {
+			logReadError(info, err)
+			return
 		}
 	}
+	if *maxConnBytes > 0 {
+		reader = &sizeLimitReader{reader: reader, left: int64(*maxConnBytes), info: info}
+	}
+	if *checksum != "none" {
+		info.digest = newStreamDigest()
+		reader = io.TeeReader(reader, info.digest)
+	}
 	if *chunk {
-		handleRequestInChunk(reader, addr, file)
+		handleRequestInChunk(reader, info, file)
+	} else if *hybrid {
+		handleRequestInHybrid(reader, info, file)
 	} else {
-		handleRequestInText(reader, addr, file)
+		handleRequestInText(reader, info, file)
+	}
+}
+
+// checkMagic peeks the first bytes of the reader without consuming them,
+// unless --strip-magic is given.
+func checkMagic(reader io.Reader) (io.Reader, bool) {
+	peekReader := bufio.NewReader(reader)
+	header, _ := peekReader.Peek(len(requireMagic))
+	if !bytes.Equal(header, requireMagic) {
+		return peekReader, false
+	}
+	if *stripMagic {
+		peekReader.Discard(len(requireMagic))
 	}
+	return peekReader, true
 }
 
-func handleRequestInChunk(reader io.Reader, addr net.Addr, file *os.File) {
-	var written int64
+func handleRequestInChunk(reader io.Reader, info *connInfo, file *outputFile) {
 	defer func() {
-		log("Connection %s closed, read bytes %d\n", addr, written)
-		handleMutex.Unlock()
+		logConn(info, "close", "Connection %s closed, read bytes %d%s\n", info.addr, info.Bytes, limitNote(info))
 	}()
-	buf := make([]byte, 64*1024)
-	written, err := io.CopyBuffer(file, reader, buf)
+	buf := chunkBufferPool.Get()
+	defer chunkBufferPool.Put(buf, len(*buf))
+	dst, done := chunkWriter(info, file)
+	defer done()
+	var err error
+	info.Bytes, err = io.CopyBuffer(dst, reader, *buf)
 	if err != nil {
-		log("Read error: %s\n", err.Error())
+		logReadError(info, err)
+	}
+}
+
+// chunkWriter returns the writer of the chunks read and a function to call
+// once the connection is done.
+func chunkWriter(info *connInfo, file *outputFile) (io.Writer, func()) {
+	var dst io.Writer = file
+	done := func() {}
+	if *hexDump {
+		dumper := &hexDumper{w: file}
+		dst = dumper
+		done = func() { dumper.Close() }
+	}
+	if wsBroadcast != nil {
+		dst = io.MultiWriter(dst, wsBroadcast)
+	}
+	if len(upstreams) > 0 {
+		dst = io.MultiWriter(dst, upstreams)
+	}
+	if info.idle != nil {
+		dst = io.MultiWriter(dst, info.idle)
 	}
+	return dst, done
 }
 
-func handleRequestInText(reader io.Reader, addr net.Addr, file *os.File) {
+func handleRequestInText(reader io.Reader, info *connInfo, file *outputFile) {
 	scanner := bufio.NewScanner(reader)
-	scanner.Split(scanLines)
+	splitter := &lineSplitter{max: maxLineLength, policy: *onLongLine, info: info}
+	if *maxLine > 0 {
+		splitter.max = int(*maxLine)
+	}
 	var buf []byte
-	scanner.Buffer(buf, maxLineLength)
+	if framing != nil {
+		scanner.Split(framing.split(splitter.max))
+		scanner.Buffer(buf, framing.size+splitter.max)
+	} else if *syslogMode {
+		scanner.Split(syslogSplit(splitter))
+		scanner.Buffer(buf, splitter.max+11)
+	} else {
+		scanner.Split(splitter.split)
+		// room for the newline ending a line of the maximum length
+		scanner.Buffer(buf, splitter.max+1)
+	}
 
-	var lines int64
 	defer func() {
-		log("Connection %s closed, read lines %d\n", addr, lines)
+		logConn(info, "close", "Connection %s closed, read lines %d%s\n", info.addr, info.Lines, limitNote(info))
 	}()
 	for scanner.Scan() {
-		file.Write(scanner.Bytes())
-		lines++
+		line := scanner.Bytes()
+		if splitter.truncated || *syslogMode && len(line) > 0 && line[len(line)-1] != delimiter {
+			line = append(line[:len(line):len(line)], delimiter)
+		}
+		info.Lines++
+		if *requireUtf8 && !utf8.Valid(line) {
+			log("Invalid UTF-8 line from %s\n", info.addr)
+			info.Rejected++
+			rejectLine(line)
+			continue
+		}
+		if schema != nil {
+			if err := validateLine(line); err != nil {
+				log("Invalid line from %s: %s\n", info.addr, err.Error())
+				info.Rejected++
+				rejectLine(line)
+				continue
+			}
+		}
+		if !grepLine(line) {
+			continue
+		}
+		target := file
+		if file.router != nil {
+			if target = file.router.route(info, line); target == nil {
+				continue
+			}
+		}
+		if *lineSample > 1 && !target.sample(*lineSample) {
+			continue
+		}
+		if *escapeBinaryData {
+			line = escapeBinary(line)
+		}
+		if prefixTemplate != nil {
+			line = prefixLine(info, line)
+		}
+		if _, err := target.Write(line); err != nil {
+			info.Error = err.Error()
+			logConn(info, "error", "Write %s error: %s\n", target.label(), err.Error())
+			return
+		}
+		info.Bytes += int64(len(line))
+		info.idle.touch()
+		wsBroadcast.Broadcast(websocket.TextMessage, line)
+		upstreams.Write(line)
 	}
 	if scanner.Err() != nil {
-		log("Read error: %s\n", scanner.Err().Error())
+		logReadError(info, scanner.Err())
+	}
+}
+
+func compilePatterns(flag string, exprs []string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, expr := range exprs {
+		p, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", flag, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// grepLine reports whether the line passes --grep and --grep-v, which match
+// it without the delimiter.
+func grepLine(line []byte) bool {
+	if len(grepPatterns) == 0 && len(grepVPatterns) == 0 {
+		return true
+	}
+	line = bytes.TrimSuffix(line, []byte{delimiter})
+	for _, p := range grepVPatterns {
+		if p.Match(line) {
+			return false
+		}
+	}
+	if len(grepPatterns) == 0 {
+		return true
+	}
+	for _, p := range grepPatterns {
+		if p.Match(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixLine renders --prefix for the line, both are written at once so that
+// lines of concurrent connections never interleave.
+func prefixLine(info *connInfo, line []byte) []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0, 64+len(line)))
+	err := prefixTemplate.Execute(buffer, connBinding(info, ""))
+	if err != nil {
+		log("Prefix template error: %s\n", err.Error())
+		return line
+	}
+	buffer.Write(line)
+	return buffer.Bytes()
+}
+
+type ackBinding struct {
+	*templateBinding
+	Bytes  int64
+	Lines  int64
+	Digest string
+	Error  string
+}
+
+func checkAckTemplate(text string) (*template.Template, error) {
+	t, err := template.New("ack").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
 	}
+	buffer := bytes.NewBuffer([]byte{})
+	err = t.Execute(buffer, &ackBinding{newTemplateBinding(1, "127.0.0.1", 8080, 8080, "key", time.Now()), 1, 1, "digest", "error"})
+	return t, err
+}
+
+// ackReply renders --ack for a connection read completely, or --ack-error
+// when reading, writing or --ack-sync failed. It is nil when no reply is
+// wanted.
+func ackReply(info *connInfo) []byte {
+	if ackTemplate == nil && ackErrorTemplate == nil {
+		return nil
+	}
+	if *ackSync && info.Error == "" && info.output != nil {
+		if err := syncOutput(info.output); err != nil {
+			info.Error = err.Error()
+			logConn(info, "error", "Sync %s error: %s\n", info.output.label(), err.Error())
+		}
+	}
+	t := ackTemplate
+	if info.Error != "" {
+		t = ackErrorTemplate
+	}
+	if t == nil {
+		return nil
+	}
+	binding := &ackBinding{connBinding(info, ""), info.Bytes, info.Lines, "", info.Error}
+	if info.digest != nil {
+		binding.Digest = hex.EncodeToString(info.digest.Sum(nil))
+	}
+	buffer := bytes.NewBuffer([]byte{})
+	if err := t.Execute(buffer, binding); err != nil {
+		log("Ack template error: %s\n", err.Error())
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+// syncOutput writes out what --disk-rate and --buffered hold back and syncs
+// the file to disk.
+func syncOutput(o *outputFile) error {
+	if o.throttle != nil {
+		if err := o.throttle.Flush(); err != nil {
+			return err
+		}
+	}
+	return o.Sync()
+}
+
+// limitNote tells in the close log whether the connection ran into a limit.
+func limitNote(info *connInfo) string {
+	switch {
+	case info.Truncated:
+		return ", cut at --max-bytes-per-conn"
+	case info.Throttled:
+		return ", throttled"
+	}
+	return ""
+}
+
+// logReadError reports why reading a connection stopped, running into
+// --timeout or --max-conn-duration counts as a regular close.
+func logReadError(info *connInfo, err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if errors.Is(err, errConnExpired) {
+			log("Connection %s open for %s, close it\n", info.addr, *maxConnDuration)
+		} else {
+			log("Connection %s idle for %s, close it\n", info.addr, *timeout)
+		}
+		return
+	}
+	info.Error = err.Error()
+	logConn(info, "error", "Read error: %s\n", err.Error())
+}
+
+var errConnExpired = fmt.Errorf("%w, open for --max-conn-duration", os.ErrDeadlineExceeded)
+
+type deadlineReader struct {
+	conn    streamConn
+	timeout time.Duration
+	start   time.Time
+	err     error
+}
+
+// Read refreshes the deadline of --timeout before every read, bounded by
+// --max-conn-duration since the start. Once it passed the reader keeps failing
+// instead of waiting for another timeout.
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	var deadline time.Time
+	if r.timeout > 0 {
+		deadline = time.Now().Add(r.timeout)
+	}
+	end := r.start.Add(*maxConnDuration)
+	expiring := *maxConnDuration > 0 && (deadline.IsZero() || end.Before(deadline))
+	if expiring {
+		deadline = end
+	}
+	r.conn.SetReadDeadline(deadline)
+	n, err := r.conn.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if expiring {
+			err = errConnExpired
+		}
+		r.err = err
+	}
+	return n, err
 }
 
 func log(format string, a ...interface{}) {
-	if *verbose {
-		fmt.Fprintf(os.Stderr, format, a...)
+	if !*verbose {
+		return
+	}
+	if *logFormat == "json" {
+		writeLogEvent("info", fmt.Sprintf(format, a...), nil)
+		return
+	}
+	fmt.Fprintf(logOutput, format, a...)
+}
+
+func checkLogTemplate(text string) (*template.Template, error) {
+	t, err := template.New("log").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := bytes.NewBuffer([]byte{})
+	err = t.Execute(buffer, &connInfo{
+		Event: "close",
+		Ip:    "127.0.0.1",
+		Port:  8080,
+		Id:    1,
+	})
+	return t, err
+}
+
+// logConn logs a connection event, formatted by --log-template when given or
+// by format otherwise.
+func logConn(info *connInfo, event string, format string, a ...interface{}) {
+	if !*verbose {
+		return
+	}
+	info.Event = event
+	info.Duration = time.Since(info.start)
+	if *logFormat == "json" {
+		level := "info"
+		if event == "error" {
+			level = "error"
+		}
+		writeLogEvent(level, fmt.Sprintf(format, a...), info)
+		return
+	}
+	if logTemplate == nil {
+		log(format, a...)
+		return
+	}
+	buffer := bytes.NewBuffer([]byte{})
+	if err := logTemplate.Execute(buffer, info); err != nil {
+		log("Log template error: %s\n", err.Error())
+		return
+	}
+	if !bytes.HasSuffix(buffer.Bytes(), []byte{'\n'}) {
+		buffer.WriteByte('\n')
+	}
+	logOutput.Write(buffer.Bytes())
+}
+
+func warn(format string, a ...interface{}) {
+	if *logFormat == "json" {
+		writeLogEvent("warn", fmt.Sprintf(format, a...), nil)
+		return
 	}
+	fmt.Fprintf(logOutput, format, a...)
 }
 
 func exit(a ...interface{}) {
-	fmt.Fprintln(os.Stderr, a...)
-	os.Exit(1)
+	if *logFormat == "json" {
+		writeLogEvent("error", fmt.Sprintln(a...), nil)
+	} else {
+		fmt.Fprintln(logOutput, a...)
+	}
+	quit(1)
+}
+
+func quit(code int) {
+	statsd.Flush()
+	shutdownOtel()
+	closeTarOutput()
+	closeOutputFiles()
+	upstreams.close()
+	closePublisher()
+	killCommands()
+	control.Close()
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		logSummary()
+	}
+	writeStatsFile()
+	// a socket passed in belongs to the one who created it
+	if *unixSocket && len(listenFds) == 0 {
+		listenerMutex.Lock()
+		for _, l := range tcpListeners {
+			l.Close()
+		}
+		// a datagram socket is not unlinked on close
+		for _, l := range udpListeners {
+			l.Close()
+			os.Remove(l.LocalAddr().String())
+		}
+		listenerMutex.Unlock()
+	}
+	os.Exit(code)
 }
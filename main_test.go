@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The flags are global, so the tests run recv.sh as a child process of the
+// test binary, which is built with -race as well under go test -race.
+func TestMain(m *testing.M) {
+	if os.Getenv("RECV_TEST_MAIN") == "1" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+type recvProcess struct {
+	cmd  *exec.Cmd
+	addr string
+	done chan struct{}
+	err  error
+
+	mutex  sync.Mutex
+	stderr bytes.Buffer
+}
+
+// startRecv runs recv.sh in dir listening on a free port of 127.0.0.1, and
+// waits until it listens.
+func startRecv(t *testing.T, dir string, args ...string) *recvProcess {
+	t.Helper()
+	return startRecvEnv(t, dir, nil, append([]string{"127.0.0.1:0"}, args...)...)
+}
+
+// startRecvEnv is startRecv with the environment variables added and without
+// the address argument.
+func startRecvEnv(t *testing.T, dir string, env []string, args ...string) *recvProcess {
+	t.Helper()
+	p := &recvProcess{done: make(chan struct{})}
+	p.cmd = exec.Command(os.Args[0], append([]string{"-v"}, args...)...)
+	p.cmd.Dir = dir
+	p.cmd.Env = append(append(os.Environ(), env...), "RECV_TEST_MAIN=1")
+	stderr, err := p.cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.cmd.Process.Kill()
+		<-p.done
+	})
+	listening := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if addr, ok := strings.CutPrefix(line, "Listening on "); ok {
+				listening <- addr
+			}
+			p.mutex.Lock()
+			p.stderr.WriteString(line + "\n")
+			p.mutex.Unlock()
+		}
+		p.err = p.cmd.Wait()
+		close(p.done)
+	}()
+	select {
+	case p.addr = <-listening:
+	case <-p.done:
+		t.Fatalf("recv.sh exited: %v\n%s", p.err, p.log())
+	case <-time.After(10 * time.Second):
+		t.Fatalf("recv.sh does not listen\n%s", p.log())
+	}
+	return p
+}
+
+func (p *recvProcess) log() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.stderr.String()
+}
+
+// wait waits for recv.sh to exit by itself, i.e. after --count connections,
+// and fails the test unless it exited cleanly.
+func (p *recvProcess) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-p.done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("recv.sh does not exit\n%s", p.log())
+	}
+	if p.err != nil {
+		t.Fatalf("recv.sh exited: %v\n%s", p.err, p.log())
+	}
+}
+
+// send writes the data on a new connection and waits for recv.sh to close
+// it.
+func send(t *testing.T, addr string, data string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	if _, err = io.WriteString(conn, data); err != nil {
+		t.Error(err)
+		return
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	io.Copy(io.Discard, conn)
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestConcurrentConnections(t *testing.T) {
+	const conns, lines = 50, 100
+	dir := t.TempDir()
+	p := startRecv(t, dir, "out-{{.Ip}}.txt", "--count", fmt.Sprint(conns))
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var data strings.Builder
+			for j := 0; j < lines; j++ {
+				fmt.Fprintf(&data, "conn %02d line %03d\n", i, j)
+			}
+			send(t, p.addr, data.String())
+		}(i)
+	}
+	wg.Wait()
+	p.wait(t)
+
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(readFile(t, filepath.Join(dir, "out-127.0.0.1.txt")), "\n"), "\n") {
+		if seen[line] {
+			t.Errorf("line %q written twice", line)
+		}
+		seen[line] = true
+	}
+	for i := 0; i < conns; i++ {
+		for j := 0; j < lines; j++ {
+			if line := fmt.Sprintf("conn %02d line %03d", i, j); !seen[line] {
+				t.Errorf("line %q missing", line)
+			}
+		}
+	}
+}
+
+func TestChunkMutexSequential(t *testing.T) {
+	dir := t.TempDir()
+	p := startRecv(t, dir, "out.bin", "--chunk", "--mutex", "--count", "2")
+	send(t, p.addr, "first\x00")
+	send(t, p.addr, "second\x00")
+	p.wait(t)
+	if got := readFile(t, filepath.Join(dir, "out.bin")); got != "first\x00second\x00" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key to
+// cert.pem and key.pem in dir.
+func writeCert(t *testing.T, dir string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "recv.sh test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	if err = os.WriteFile(filepath.Join(dir, "cert.pem"), certPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "key.pem"), keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestTls(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeCert(t, dir)
+	p := startRecv(t, dir, "out.txt", "--tls-cert", "cert.pem", "--tls-key", "key.pem", "--count", "1")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	conn, err := tls.Dial("tcp", p.addr, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = io.WriteString(conn, "first line\nsecond line\n"); err != nil {
+		t.Fatal(err)
+	}
+	conn.CloseWrite()
+	io.Copy(io.Discard, conn)
+	p.wait(t)
+	if got := readFile(t, filepath.Join(dir, "out.txt")); got != "first line\nsecond line\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestOnLongLine(t *testing.T) {
+	for _, test := range []struct {
+		policy string
+		want   string
+	}{
+		{"close", "short\n"},
+		{"skip", "short\nafter\n"},
+		{"truncate-write", "short\nwaytoolo\nafter\n"},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			dir := t.TempDir()
+			p := startRecv(t, dir, "out.txt", "--max-line", "8B", "--on-long-line", test.policy, "--count", "1")
+			send(t, p.addr, "short\nwaytoolongline\nafter\n")
+			p.wait(t)
+			if got := readFile(t, filepath.Join(dir, "out.txt")); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "short\n"},
+		{[]string{"--append"}, "a much longer payload\nshort\n"},
+	} {
+		t.Run(fmt.Sprint(test.args), func(t *testing.T) {
+			dir := t.TempDir()
+			for _, data := range []string{"a much longer payload\n", "short\n"} {
+				p := startRecv(t, dir, append([]string{"out.txt", "--count", "1"}, test.args...)...)
+				send(t, p.addr, data)
+				p.wait(t)
+			}
+			if got := readFile(t, filepath.Join(dir, "out.txt")); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEnv(t *testing.T) {
+	for _, test := range []struct {
+		env  []string
+		args []string
+		want string
+	}{
+		{[]string{"RECV_ADDR=127.0.0.1:0", "RECV_FILE=env.txt"}, nil, "env.txt"},
+		{[]string{"RECV_ADDR=127.0.0.1:0"}, []string{"arg.txt"}, "arg.txt"},
+		{[]string{"RECV_ADDR=127.0.0.1:0", "RECV_FILE=env.txt"}, []string{"arg.txt"}, "arg.txt"},
+		{[]string{"RECV_ADDR=invalid", "RECV_FILE=env.txt"}, []string{"127.0.0.1:0", "arg.txt"}, "arg.txt"},
+	} {
+		t.Run(fmt.Sprint(test.env, test.args), func(t *testing.T) {
+			dir := t.TempDir()
+			p := startRecvEnv(t, dir, test.env, append(test.args, "--count", "1")...)
+			send(t, p.addr, "line\n")
+			p.wait(t)
+			if got := readFile(t, filepath.Join(dir, test.want)); got != "line\n" {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+}
+
+func TestWalReplayUnixgram(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "wal"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	entry := "unixgram \"\" 1 \"out.txt\"\nreplayed\n"
+	if err := os.WriteFile(filepath.Join(dir, "wal", "1-1.wal"), []byte(entry), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the logs are replayed before listening
+	startRecvEnv(t, dir, nil, "recv.sock", "out.txt", "--unix-dgram", "--wal", "wal", "--append")
+	if got := readFile(t, filepath.Join(dir, "out.txt")); got != "replayed\n" {
+		t.Errorf("got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "wal", "1-1.wal")); !os.IsNotExist(err) {
+		t.Errorf("log not removed: %v", err)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Name = "data.txt"
+	io.WriteString(gz, "gzipped\n")
+	gz.Close()
+	for _, test := range []struct {
+		name string
+		data string
+		want string
+	}{
+		{"gzip", compressed.String(), "gzipped\n"},
+		// starts like zlib and bzip2, which only --compress=auto detects
+		{"plain", "x^BZh1 plain\n", "x^BZh1 plain\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := startRecv(t, dir, "out.txt", "-z", "--count", "1")
+			send(t, p.addr, test.data)
+			p.wait(t)
+			if got := readFile(t, filepath.Join(dir, "out.txt")); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHttpCount(t *testing.T) {
+	dir := t.TempDir()
+	p := startRecv(t, dir, "out.txt", "--http", "--count", "1")
+	resp, err := http.Post("http://"+p.addr+"/upload", "text/plain", strings.NewReader("posted\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status %s", resp.Status)
+	}
+	p.wait(t)
+	if got := readFile(t, filepath.Join(dir, "out.txt")); got != "posted\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	dir := t.TempDir()
+	p := startRecv(t, dir, "out.txt", "--max-conn", "1", "--queue-timeout", "200ms", "--count", "2")
+	first, err := net.Dial("tcp", p.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err = io.WriteString(first, "first\n"); err != nil {
+		t.Fatal(err)
+	}
+	second, err := net.Dial("tcp", p.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.Copy(io.Discard, second); os.IsTimeout(err) {
+		t.Fatalf("second connection not refused\n%s", p.log())
+	}
+	first.(*net.TCPConn).CloseWrite()
+	io.Copy(io.Discard, first)
+	p.wait(t)
+	if got := readFile(t, filepath.Join(dir, "out.txt")); got != "first\n" {
+		t.Errorf("got %q", got)
+	}
+	if !strings.Contains(p.log(), ", 1 after --queue-timeout") {
+		t.Errorf("timeout not counted\n%s", p.log())
+	}
+}
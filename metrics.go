@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// counters served by --metrics-addr in the prometheus text format
+var (
+	activeConns  int64
+	writeErrors  int64
+	droppedBytes int64
+	peerBytes    = make(map[string]int64)
+	peerMutex    sync.Mutex
+)
+
+func serveMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	if *statsInterval > 0 || *statsFile != "" {
+		mux.HandleFunc("/stats", writeStats)
+	}
+	go func() {
+		err := http.Serve(listener, mux)
+		log("Metrics server closed: %s\n", err.Error())
+	}()
+	return nil
+}
+
+// countPeerBytes adds the bytes of a finished connection to its sender.
+func countPeerBytes(info *connInfo) {
+	if *metricsAddr == "" {
+		return
+	}
+	peerMutex.Lock()
+	peerBytes[info.Ip] += info.Bytes
+	peerMutex.Unlock()
+}
+
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	metric("recv_active_connections", "gauge", "Connections being handled.", atomic.LoadInt64(&activeConns))
+	metric("recv_connections_total", "counter", "Connections handled.", atomic.LoadInt64(&totalConns))
+	metric("recv_bytes_total", "counter", "Bytes received.", atomic.LoadInt64(&totalBytes))
+	metric("recv_lines_total", "counter", "Lines received.", atomic.LoadInt64(&totalLines))
+	metric("recv_refused_total", "counter", "Connections and datagrams refused by --allow or --deny.", atomic.LoadInt64(&refused))
+	metric("recv_rejected_ips_total", "counter", "Connections and datagrams of new source IPs refused by --reject-new-ips.", atomic.LoadInt64(&rejectedIps))
+	metric("recv_queue_timeouts_total", "counter", "Connections refused after waiting --queue-timeout for a slot.", atomic.LoadInt64(&queueTimeouts))
+	metric("recv_write_errors_total", "counter", "Failed writes to output files.", atomic.LoadInt64(&writeErrors))
+	metric("recv_dropped_bytes_total", "counter", "Bytes dropped by --disk-full-policy drop.", atomic.LoadInt64(&droppedBytes))
+	fileMapMutex.Lock()
+	files := len(fileMap)
+	fileMapMutex.Unlock()
+	if openFiles != nil {
+		files = openFiles.count()
+	}
+	metric("recv_open_files", "gauge", "Output files open.", int64(files))
+
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+	ips := make([]string, 0, len(peerBytes))
+	for ip := range peerBytes {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	fmt.Fprintf(w, "# HELP recv_peer_bytes_total Bytes received by sender.\n# TYPE recv_peer_bytes_total counter\n")
+	for _, ip := range ips {
+		fmt.Fprintf(w, "recv_peer_bytes_total{ip=%q} %d\n", ip, peerBytes[ip])
+	}
+}
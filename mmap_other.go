@@ -0,0 +1,24 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errMmapUnsupported = errors.New("memory mapped files are not supported on this platform")
+
+type mmapFile struct{}
+
+func newMmapFile(file *os.File) (*mmapFile, error) {
+	return nil, errMmapUnsupported
+}
+
+func (m *mmapFile) Write(p []byte) (int, error) {
+	return 0, errMmapUnsupported
+}
+
+func (m *mmapFile) Close() error {
+	return nil
+}
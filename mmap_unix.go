@@ -0,0 +1,70 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// the mapping grows by this much whenever it runs full
+const mmapChunk = 16 * 1024 * 1024
+
+// mmapFile writes to a file through a shared memory mapping.
+type mmapFile struct {
+	file *os.File
+	data []byte
+	size int
+}
+
+func newMmapFile(file *os.File) (*mmapFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m := &mmapFile{file: file, size: int(info.Size())}
+	if err = m.grow(0); err != nil {
+		file.Truncate(int64(m.size))
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *mmapFile) grow(n int) error {
+	length := (m.size + n + mmapChunk) / mmapChunk * mmapChunk
+	if m.data != nil {
+		if err := unix.Munmap(m.data); err != nil {
+			return err
+		}
+		m.data = nil
+	}
+	if err := m.file.Truncate(int64(length)); err != nil {
+		return err
+	}
+	data, err := unix.Mmap(int(m.file.Fd()), 0, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+func (m *mmapFile) Write(p []byte) (int, error) {
+	if m.size+len(p) > len(m.data) {
+		if err := m.grow(len(p)); err != nil {
+			return 0, err
+		}
+	}
+	copy(m.data[m.size:], p)
+	m.size += len(p)
+	return len(p), nil
+}
+
+// Close unmaps the file and cuts off the unused tail of the last chunk.
+func (m *mmapFile) Close() error {
+	if err := unix.Munmap(m.data); err != nil {
+		return err
+	}
+	m.data = nil
+	return m.file.Truncate(int64(m.size))
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// data of a connection is uploaded in parts of this size, the minimum of S3
+// is 5MiB
+const uploadPartSize = 8 << 20
+
+var outputURLTemplate *template.Template
+
+// objectStore is a bucket of --output-url, reached through the S3 API. Google
+// Cloud Storage offers the same as its XML API for HMAC keys.
+type objectStore struct {
+	endpoint string
+	region   string
+	key      string
+	secret   string
+	token    string
+}
+
+// newObjectStore takes the credentials from the environment like the aws
+// cli does.
+func newObjectStore(scheme string) (*objectStore, error) {
+	s := &objectStore{
+		endpoint: *s3Endpoint,
+		region:   os.Getenv("AWS_REGION"),
+		key:      os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret:   os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	switch scheme {
+	case "s3":
+		if s.region == "" {
+			s.region = "us-east-1"
+		}
+		if s.endpoint == "" {
+			s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+		}
+	case "gs":
+		s.region = "auto"
+		if s.endpoint == "" {
+			s.endpoint = "https://storage.googleapis.com"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported --output-url scheme %q, expect s3:// or gs://", scheme)
+	}
+	if s.key == "" || s.secret == "" {
+		return nil, fmt.Errorf("--output-url requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return s, nil
+}
+
+var objectStores = make(map[string]*objectStore)
+
+// checkOutputURL parses the --output-url template and sets up the store of its
+// scheme.
+func checkOutputURL(text string) (*template.Template, error) {
+	t, err := checkTemplate("outputURL", text)
+	if err != nil {
+		return nil, err
+	}
+	// the template itself does not need to be a valid url
+	scheme, _, _ := strings.Cut(text, "://")
+	s, err := newObjectStore(scheme)
+	if err != nil {
+		return nil, err
+	}
+	objectStores[scheme] = s
+	return t, nil
+}
+
+// newUpload starts the upload of a connection to the rendered --output-url.
+func newUpload(rawURL string) (*objectUpload, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	s := objectStores[u.Scheme]
+	if s == nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("invalid output url %q", rawURL)
+	}
+	return &objectUpload{store: s, bucket: u.Host, key: strings.TrimPrefix(u.Path, "/"), name: rawURL}, nil
+}
+
+// objectUpload sends the data of one connection as an object. It stays a
+// single PUT unless the data exceeds a part, then it turns into a multipart
+// upload.
+type objectUpload struct {
+	store    *objectStore
+	bucket   string
+	key      string
+	name     string
+	buf      bytes.Buffer
+	uploadId string
+	etags    []string
+	err      error
+}
+
+func (u *objectUpload) Write(p []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+	u.buf.Write(p)
+	for u.buf.Len() >= uploadPartSize {
+		if u.err = u.uploadPart(u.buf.Next(uploadPartSize)); u.err != nil {
+			return 0, u.err
+		}
+	}
+	return len(p), nil
+}
+
+func (u *objectUpload) uploadPart(part []byte) error {
+	if u.uploadId == "" {
+		resp, err := u.store.do("POST", u.bucket, u.key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadId string
+		}
+		if err = xml.Unmarshal(resp, &result); err != nil {
+			return err
+		}
+		u.uploadId = result.UploadId
+	}
+	query := url.Values{"partNumber": {strconv.Itoa(len(u.etags) + 1)}, "uploadId": {u.uploadId}}
+	etag, err := u.store.put(u.bucket, u.key, query, part)
+	if err != nil {
+		return err
+	}
+	u.etags = append(u.etags, etag)
+	return nil
+}
+
+// commit completes the object, or aborts a multipart upload which failed.
+func (u *objectUpload) commit() error {
+	if u.err != nil {
+		if u.uploadId != "" {
+			u.store.do("DELETE", u.bucket, u.key, url.Values{"uploadId": {u.uploadId}}, nil)
+		}
+		return u.err
+	}
+	if u.uploadId == "" {
+		_, err := u.store.put(u.bucket, u.key, nil, u.buf.Bytes())
+		return err
+	}
+	if u.buf.Len() > 0 {
+		if err := u.uploadPart(u.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	body := bytes.NewBufferString("<CompleteMultipartUpload>")
+	for i, etag := range u.etags {
+		fmt.Fprintf(body, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, etag)
+	}
+	body.WriteString("</CompleteMultipartUpload>")
+	_, err := u.store.do("POST", u.bucket, u.key, url.Values{"uploadId": {u.uploadId}}, body.Bytes())
+	return err
+}
+
+func (s *objectStore) put(bucket, key string, query url.Values, body []byte) (string, error) {
+	req, err := s.request("PUT", bucket, key, query, body)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("upload %s/%s: %s %s", bucket, key, resp.Status, msg)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *objectStore) do(method, bucket, key string, query url.Values, body []byte) ([]byte, error) {
+	req, err := s.request(method, bucket, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// a completed multipart upload may still report an error with 200
+	if resp.StatusCode/100 != 2 || bytes.Contains(data, []byte("<Error>")) {
+		return nil, fmt.Errorf("upload %s/%s: %s %s", bucket, key, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// request builds a path-style request signed with AWS signature version 4.
+func (s *objectStore) request(method, bucket, key string, query url.Values, body []byte) (*http.Request, error) {
+	path := "/" + bucket + "/" + key
+	req, err := http.NewRequest(method, s.endpoint+uriEncode(path, false)+canonicalQuery(query), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+	req.Header.Set("X-Amz-Date", time.Now().UTC().Format("20060102T150405Z"))
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+	s.sign(req, uriEncode(path, false), hex.EncodeToString(hash[:]))
+	return req, nil
+}
+
+// ref: https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *objectStore) sign(req *http.Request, path, payloadHash string) {
+	amzDate := req.Header.Get("X-Amz-Date")
+	date := amzDate[:8]
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.TrimPrefix(canonicalQuery(req.URL.Query()), "?"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.secret)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.key, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery is sorted and encoded as required by the signature, with a
+// leading '?' unless empty.
+func canonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return "?" + strings.Join(pairs, "&")
+}
+
+// uriEncode escapes everything but the unreserved characters of RFC 3986, and
+// '/' unless slash is given.
+func uriEncode(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !slash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// openFiles keeps the output files open in the order they were last written,
+// for --max-open-files and --file-idle-timeout. A closed file is opened again
+// in append mode by its next write, an encrypted one continues in a new file
+// with the next numeric suffix.
+var openFiles *openFileList
+
+type openFileList struct {
+	mutex sync.Mutex
+	list  *list.List
+	max   int
+}
+
+func newOpenFileList(max int, idle time.Duration) *openFileList {
+	l := &openFileList{list: list.New(), max: max}
+	if idle > 0 {
+		go l.closeIdle(idle)
+	}
+	return l
+}
+
+// use marks o as written just now and closes the least recently written files
+// beyond --max-open-files. It is called with o.mutex held.
+func (l *openFileList) use(o *outputFile) {
+	if l == nil || o.name == "" {
+		return
+	}
+	l.mutex.Lock()
+	o.used = time.Now()
+	if o.lru == nil {
+		o.lru = l.list.PushFront(o)
+	} else {
+		l.list.MoveToFront(o.lru)
+	}
+	var victims []*outputFile
+	for l.max > 0 && l.list.Len() > l.max {
+		victims = append(victims, l.remove(l.list.Back()))
+	}
+	l.mutex.Unlock()
+	for _, victim := range victims {
+		// the victim may be written right now, it must not be waited for
+		// while holding the lock of o
+		go victim.evict()
+	}
+}
+
+// forget drops o once it is closed, with o.mutex held.
+func (l *openFileList) forget(o *outputFile) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	if o.lru != nil {
+		l.remove(o.lru)
+	}
+	l.mutex.Unlock()
+}
+
+func (l *openFileList) remove(e *list.Element) *outputFile {
+	o := l.list.Remove(e).(*outputFile)
+	o.lru = nil
+	return o
+}
+
+func (l *openFileList) count() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.list.Len()
+}
+
+func (l *openFileList) closeIdle(idle time.Duration) {
+	for range time.Tick(idle / 2) {
+		var victims []*outputFile
+		l.mutex.Lock()
+		for e := l.list.Back(); e != nil && time.Since(e.Value.(*outputFile).used) >= idle; e = l.list.Back() {
+			victims = append(victims, l.remove(e))
+		}
+		l.mutex.Unlock()
+		for _, victim := range victims {
+			victim.evict()
+		}
+	}
+}
+
+// evict closes the file unless it was written again since it was picked.
+func (o *outputFile) evict() {
+	if o.throttle != nil {
+		o.throttle.Flush()
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	openFiles.mutex.Lock()
+	picked := o.lru == nil
+	openFiles.mutex.Unlock()
+	if !picked || o.file == nil {
+		return
+	}
+	log("Close output file %s until it is written again\n", o.path)
+	if err := o.close(); err != nil {
+		log("Close %s error: %s\n", o.path, err.Error())
+	}
+	o.file = nil
+	if ageRecipients != nil {
+		// an encrypted file can not be appended to
+		o.seq++
+	} else {
+		o.reopen = true
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+var (
+	tracerProvider *sdktrace.TracerProvider
+	tracer         trace.Tracer
+)
+
+func setupOtel(endpoint string) error {
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		return err
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "recv.sh"))),
+	)
+	tracer = tracerProvider.Tracer("github.com/six-ddc/recv.sh")
+	return nil
+}
+
+// shutdownOtel exports the spans still queued, waiting a few seconds at most.
+func shutdownOtel() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log("Shutdown OpenTelemetry error: %s\n", err.Error())
+	}
+}
+
+// startConnSpan starts the span of a connection at the time it was accepted.
+func startConnSpan(info *connInfo) trace.Span {
+	if tracer == nil {
+		return nil
+	}
+	_, span := tracer.Start(context.Background(), "connection",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(info.start),
+		trace.WithAttributes(
+			attribute.String("net.peer.ip", info.Ip),
+			attribute.Int("net.peer.port", info.Port),
+			attribute.Int64("recv.id", info.Id),
+		),
+	)
+	return span
+}
+
+func endConnSpan(span trace.Span, info *connInfo) {
+	if span == nil {
+		return
+	}
+	span.SetAttributes(
+		attribute.Int64("recv.bytes", info.Bytes),
+		attribute.Int64("recv.lines", info.Lines),
+		attribute.Int64("recv.duration_ms", time.Since(info.start).Milliseconds()),
+	)
+	if info.Error != "" {
+		span.SetStatus(codes.Error, info.Error)
+	}
+	span.End()
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// outputFile is shared by all connections writing to the same output name.
+type outputFile struct {
+	lines int64 // first for 64-bit atomic alignment
+
+	mutex sync.Mutex
+	name  string
+	path  string
+	file  *os.File
+	date  string
+
+	// for --max-size and --rotate-interval
+	size      int64
+	seq       int
+	lineEnded bool
+	opened    time.Time
+
+	throttle *diskThrottle
+	entry    *tarEntry
+	command  *command
+	upload   *objectUpload
+	publish  *linePublisher
+	router   *syslogRouter
+	mapped   *mmapFile
+	buffer   *bufio.Writer
+	encoder  encoder
+	part     bool
+	// written to buffer since the last flush, for --flush-bytes
+	unflushed int64
+	// stdout whose reader went away
+	closed bool
+
+	// for --max-open-files and --file-idle-timeout
+	lru    *list.Element
+	used   time.Time
+	reopen bool
+}
+
+// the output file exists already with --on-conflict skip
+var errFileExists = errors.New("output file exists")
+
+var (
+	stdoutFile   = &outputFile{file: os.Stdout}
+	symlinkMutex sync.Mutex
+)
+
+func openOutputFile(fileName string) *outputFile {
+	fileMapMutex.Lock()
+	defer fileMapMutex.Unlock()
+
+	if file, ok := fileMap[fileName]; ok {
+		return file
+	}
+
+	file := &outputFile{name: fileName}
+	if err := file.open(); errors.Is(err, errFileExists) {
+		log("Skip the connection, %s\n", err.Error())
+		return nil
+	} else if err != nil {
+		fileMapMutex.Unlock()
+		exit(err)
+	}
+	if diskLimiter != nil || *asyncWrites {
+		file.throttle = newDiskThrottle(file.write, int(*diskBuffer))
+	}
+	fileMap[fileName] = file
+	return file
+}
+
+func (o *outputFile) open() error {
+	mode := os.O_CREATE | os.O_WRONLY
+	if *dailyAppend {
+		o.date = time.Now().Format("2006-01-02")
+	}
+	if *app || *dailyAppend || o.reopen {
+		mode |= os.O_APPEND
+	} else {
+		// leave no bytes of a previous, longer run behind
+		mode |= os.O_TRUNC
+	}
+	path := o.finalPath()
+	if !o.reopen && *onConflict == "skip" && o.opened.IsZero() && fileExists(path) {
+		return fmt.Errorf("%s: %w", path, errFileExists)
+	}
+	for !o.reopen && *onConflict == "number" && fileExists(path) {
+		o.seq++
+		path = o.finalPath()
+	}
+	if o.part {
+		path += ".part"
+	}
+	if *mmapOutput {
+		// a shared mapping needs the file to be readable as well
+		mode = mode&^os.O_WRONLY | os.O_RDWR
+	}
+	// a templated name may point into directories that do not exist yet
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, mode, 0644)
+	if err != nil {
+		return err
+	}
+	o.file = file
+	o.path = path
+	o.size = 0
+	o.lineEnded = true
+	o.opened = time.Now()
+	if mode&os.O_APPEND != 0 {
+		if stat, err := file.Stat(); err == nil {
+			o.size = stat.Size()
+		}
+	}
+	if *mmapOutput {
+		if o.mapped, err = newMmapFile(file); err != nil {
+			warn("Warning: cannot map %s into memory, fall back to normal writes: %s\n", path, err.Error())
+		}
+	}
+	if *buffered && o.mapped == nil {
+		o.buffer = bufio.NewWriterSize(file, int(*bufSize))
+	}
+	if !o.part {
+		updateLatestSymlink(path)
+	}
+	openFiles.use(o)
+	return nil
+}
+
+// finalPath is the name with the suffixes of the date, the rotation and the
+// encryption, but not of --atomic.
+func (o *outputFile) finalPath() string {
+	path := o.name
+	if *dailyAppend {
+		path += "." + o.date
+	}
+	if o.seq > 0 {
+		path += "." + strconv.Itoa(o.seq)
+	}
+	if ageRecipients != nil && !strings.HasSuffix(path, ".age") {
+		path += ".age"
+	}
+	return path
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// startEncoder compresses or encrypts what is written from now on, it starts
+// with the first write so that no empty stream is left behind.
+func (o *outputFile) startEncoder() error {
+	var w io.Writer = o.file
+	if o.buffer != nil {
+		w = o.buffer
+	}
+	var err error
+	if *gzipIndex && o.name != "" {
+		var stat os.FileInfo
+		if stat, err = o.file.Stat(); err != nil {
+			return err
+		}
+		o.encoder, err = newGzipIndexWriter(w, o.path, stat.Size())
+		return err
+	}
+	o.encoder, err = newEncoder(w)
+	return err
+}
+
+// closeEncoder ends the compressed or encrypted stream.
+func (o *outputFile) closeEncoder() {
+	if o.encoder == nil {
+		return
+	}
+	if err := o.encoder.Close(); err != nil {
+		log("Close stream of %s error: %s\n", o.path, err.Error())
+	}
+	o.encoder = nil
+}
+
+func (o *outputFile) close() error {
+	if o.file == nil {
+		return nil
+	}
+	openFiles.forget(o)
+	o.closeEncoder()
+	if err := o.flush(); err != nil {
+		log("Flush %s error: %s\n", o.path, err.Error())
+	}
+	if o.mapped != nil {
+		if err := o.mapped.Close(); err != nil {
+			log("Unmap %s error: %s\n", o.path, err.Error())
+		}
+		o.mapped = nil
+	}
+	return o.file.Close()
+}
+
+func (o *outputFile) Write(p []byte) (int, error) {
+	if o.throttle != nil {
+		return o.throttle.Write(p)
+	}
+	return o.write(p)
+}
+
+func (o *outputFile) write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.entry != nil {
+		return o.entry.Write(p)
+	}
+	if o.command != nil {
+		return o.command.Write(p)
+	}
+	if o.upload != nil {
+		return o.upload.Write(p)
+	}
+	if o.publish != nil {
+		return o.publish.Write(p)
+	}
+	if o.name != "" && diskSpace.low(filepath.Dir(o.name)) {
+		if *diskFullPolicy == "drop" {
+			atomic.AddInt64(&droppedBytes, int64(len(p)))
+			return len(p), nil
+		}
+		return 0, errDiskFull
+	}
+	if o.file == nil && o.name != "" {
+		// closed by --max-open-files or --file-idle-timeout meanwhile
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+	if *dailyAppend && o.name != "" && o.date != time.Now().Format("2006-01-02") {
+		o.close()
+		o.seq = 0
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+	if *rotateInterval > 0 && o.name != "" && time.Since(o.opened) >= *rotateInterval && (o.lineEnded || *chunk || *hybrid) && o.size > 0 {
+		if err := o.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if *maxSize > 0 && o.name != "" {
+		return o.writeRotating(p)
+	}
+	return o.writeFile(p)
+}
+
+// rotate continues in a new file with the next numeric suffix.
+func (o *outputFile) rotate() error {
+	o.close()
+	o.seq++
+	o.reopen = false
+	if err := o.open(); err != nil {
+		return err
+	}
+	log("Rotate output file to %s\n", o.path)
+	return nil
+}
+
+// writeRotating continues in a new file with the next numeric suffix once
+// the current one would grow beyond --max-size. In line mode a line is never
+// split between two files.
+func (o *outputFile) writeRotating(p []byte) (int, error) {
+	max := int64(*maxSize)
+	if framing != nil {
+		// a frame is written at once and never split
+		if o.size > 0 && o.size+int64(len(p)) > max {
+			if err := o.rotate(); err != nil {
+				return 0, err
+			}
+		}
+		return o.writeFile(p)
+	}
+	written := 0
+	for o.size+int64(len(p)) > max {
+		// bytes still going to the current file
+		cut := 0
+		if *chunk || *hybrid {
+			if o.size < max {
+				cut = int(max - o.size)
+			}
+		} else if !o.lineEnded {
+			// finish the line already started in the current file
+			if cut = bytes.IndexByte(p, delimiter) + 1; cut == 0 {
+				cut = len(p)
+			}
+		} else {
+			if o.size < max {
+				cut = bytes.LastIndexByte(p[:max-o.size], delimiter) + 1
+			}
+			if cut == 0 && o.size == 0 {
+				// the line alone is longer than the limit
+				cut = bytes.IndexByte(p, delimiter) + 1
+			}
+		}
+		if cut == 0 && o.size == 0 || cut == len(p) {
+			break
+		}
+		n, err := o.writeFile(p[:cut])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[cut:]
+		if err = o.rotate(); err != nil {
+			return written, err
+		}
+	}
+	n, err := o.writeFile(p)
+	return written + n, err
+}
+
+func (o *outputFile) writeFile(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if o.closed {
+		return 0, os.ErrClosed
+	}
+	openFiles.use(o)
+	o.size += int64(len(p))
+	o.lineEnded = framing != nil || p[len(p)-1] == delimiter
+	if o.mapped != nil {
+		return o.mapped.Write(p)
+	}
+	if (*compressOutput != "none" || ageRecipients != nil) && o.encoder == nil {
+		if err := o.startEncoder(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if o.encoder != nil {
+		n, err = o.encoder.Write(p)
+	} else if o.buffer != nil {
+		n, err = o.buffer.Write(p)
+	} else {
+		n, err = o.file.Write(p)
+	}
+	if o.buffer != nil && err == nil {
+		o.unflushed += int64(n)
+		if *flushBytes > 0 && o.unflushed >= int64(*flushBytes) {
+			err = o.flush()
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&writeErrors, 1)
+	}
+	if err != nil && o.name == "" && (errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed)) {
+		// the reader of our stdout went away, i.e. `recv.sh :8080 | head`
+		o.quitClosed(err)
+	}
+	return n, err
+}
+
+// quitClosed exits once stdout is closed. It is called with o.mutex held,
+// which is released for quit to flush and close the output files.
+func (o *outputFile) quitClosed(err error) {
+	log("Output closed: %s\n", err.Error())
+	o.closed = true
+	o.mutex.Unlock()
+	quit(0)
+}
+
+// sample reports whether the next line should be kept with --line-sample n,
+// counting lines of all connections writing to the file together.
+func (o *outputFile) sample(n int64) bool {
+	return (atomic.AddInt64(&o.lines, 1)-1)%n == 0
+}
+
+// label names the output in logs, "-" for stdout.
+func (o *outputFile) label() string {
+	if o.entry != nil {
+		return o.entry.name
+	}
+	if o.command != nil {
+		return o.command.line
+	}
+	if o.upload != nil {
+		return o.upload.name
+	}
+	if o.publish != nil {
+		return o.publish.topic
+	}
+	if o.router != nil {
+		return "syslog"
+	}
+	if o.name == "" {
+		return "-"
+	}
+	return o.currentPath()
+}
+
+// walName is the name the output is opened by again with outputFileByName.
+func (o *outputFile) walName() string {
+	if o.entry != nil {
+		return o.entry.name
+	}
+	return o.name
+}
+
+func (o *outputFile) currentPath() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.path
+}
+
+// Flush writes out what --buffered or --compress-output hold back for the
+// file.
+func (o *outputFile) Flush() error {
+	if o.router != nil {
+		return o.router.flush()
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.flush()
+}
+
+func (o *outputFile) flush() error {
+	if o.closed {
+		return os.ErrClosed
+	}
+	var err error
+	if o.encoder != nil {
+		err = o.encoder.Flush()
+	}
+	if o.buffer != nil && err == nil {
+		err = o.buffer.Flush()
+		o.unflushed = 0
+	}
+	if err != nil && o.name == "" && (errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed)) {
+		o.quitClosed(err)
+	}
+	return err
+}
+
+func (o *outputFile) Sync() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if err := o.flush(); err != nil {
+		return err
+	}
+	if o.name == "" || o.entry != nil || o.command != nil || o.upload != nil || o.publish != nil {
+		// stdout is usually a terminal or a pipe which can not be synced
+		return nil
+	}
+	if o.file == nil {
+		return nil
+	}
+	return o.file.Sync()
+}
+
+// flushOutputFiles flushes the buffers of all output files every interval.
+func flushOutputFiles(interval time.Duration) {
+	for range time.Tick(interval) {
+		fileMapMutex.Lock()
+		files := make([]*outputFile, 0, len(fileMap)+1)
+		for _, file := range fileMap {
+			files = append(files, file)
+		}
+		fileMapMutex.Unlock()
+		files = append(files, stdoutFile)
+		for _, file := range files {
+			if err := file.Flush(); err != nil {
+				log("Flush %s error: %s\n", file.label(), err.Error())
+			}
+		}
+	}
+}
+
+// closeOutputFiles writes out what is still buffered for the output files,
+// syncs and closes them.
+func closeOutputFiles() {
+	fileMapMutex.Lock()
+	for _, file := range fileMap {
+		if file.throttle != nil {
+			file.throttle.Close()
+		}
+		file.mutex.Lock()
+		file.flush()
+		if file.file != nil {
+			file.file.Sync()
+		}
+		if err := file.close(); err != nil {
+			log("Close %s error: %s\n", file.path, err.Error())
+		}
+		file.mutex.Unlock()
+	}
+	fileMapMutex.Unlock()
+	closeParts()
+	// not holding fileMapMutex, as an EPIPE of stdout quits again
+	stdoutFile.mutex.Lock()
+	stdoutFile.closeEncoder()
+	stdoutFile.flush()
+	stdoutFile.mutex.Unlock()
+}
+
+func updateLatestSymlink(fileName string) {
+	symlinkMutex.Lock()
+	defer symlinkMutex.Unlock()
+
+	if *latestSymlink == "" {
+		return
+	}
+	target, err := filepath.Abs(fileName)
+	if err != nil {
+		log("Update symlink error: %s\n", err.Error())
+		return
+	}
+	link, err := filepath.Abs(*latestSymlink)
+	if err != nil {
+		log("Update symlink error: %s\n", err.Error())
+		return
+	}
+	if rel, err := filepath.Rel(filepath.Dir(link), target); err == nil {
+		target = rel
+	}
+	// replace the link atomically so that `tail -F` never sees it missing
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err = os.Symlink(target, tmp); err == nil {
+		err = os.Rename(tmp, link)
+	}
+	if err != nil {
+		warn("Warning: cannot update symlink %s, disable --latest-symlink: %s\n", *latestSymlink, err.Error())
+		*latestSymlink = ""
+	}
+}
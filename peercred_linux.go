@@ -0,0 +1,27 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+// peerCred returns the pid and uid of the process at the other end of a unix
+// socket, or -1 when they are unknown.
+func peerCred(conn net.Conn) (int, int) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return -1, -1
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return -1, -1
+	}
+	var cred *unix.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return -1, -1
+	}
+	return int(cred.Pid), int(cred.Uid)
+}
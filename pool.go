@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+)
+
+// bufferPool hands out byte slices of at most size bytes, reusing them across
+// connections and datagrams when --pool-buffers is set.
+type bufferPool struct {
+	pool sync.Pool
+	size int
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, p.size)
+		return &buf
+	}
+	return p
+}
+
+func (p *bufferPool) Get() *[]byte {
+	if !*poolBuffers {
+		buf := make([]byte, p.size)
+		return &buf
+	}
+	return p.pool.Get().(*[]byte)
+}
+
+// Put returns buf to the pool, clearing the first used bytes so that the data
+// of one connection never leaks into the next one.
+func (p *bufferPool) Put(buf *[]byte, used int) {
+	if !*poolBuffers {
+		return
+	}
+	b := (*buf)[:used]
+	for i := range b {
+		b[i] = 0
+	}
+	p.pool.Put(buf)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a load balancer sends the header right away
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn strips the PROXY protocol header of --proxy-protocol and reports
+// the client address it carries as the remote address. The header is read by
+// the first call of Read or RemoteAddr.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// proxyError is the error the header was rejected with, if any.
+func (c *proxyConn) proxyError() error {
+	c.once.Do(c.readHeader)
+	return c.err
+}
+
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	sig, err := c.reader.Peek(len(proxySignature))
+	if err == nil && bytes.Equal(sig, proxySignature) {
+		c.remote, c.err = readProxyV2(c.reader)
+		return
+	}
+	c.remote, c.err = readProxyV1(c.reader)
+}
+
+// ref: https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return nil, fmt.Errorf("proxy protocol header too long")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid proxy protocol header %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("invalid proxy protocol header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid proxy protocol header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	if header[12]&0xf == 0 {
+		// LOCAL, i.e. a health check of the proxy itself
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11:
+		if len(body) >= 12 {
+			return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+		}
+	case 0x21:
+		if len(body) >= 36 {
+			return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+		}
+	default:
+		// unsupported families keep the address of the proxy
+		return nil, nil
+	}
+	return nil, fmt.Errorf("short proxy protocol address")
+}
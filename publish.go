@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// lines of a connection are published in batches of this many messages
+const publishBatchSize = 100
+
+var (
+	topicTemplate *template.Template
+	kafkaWriter   *kafka.Writer
+	natsConn      *nats.Conn
+)
+
+// startPublisher connects to --kafka-brokers or --nats and parses the
+// template of the topic or subject.
+func startPublisher() error {
+	var err error
+	if *kafkaTopic != "" {
+		if topicTemplate, err = checkTemplate("kafkaTopic", *kafkaTopic); err != nil {
+			return err
+		}
+		kafkaWriter = &kafka.Writer{
+			Addr: kafka.TCP(strings.Split(*kafkaBrokers, ",")...),
+			// lines of a sender stay in order within one partition
+			Balancer:               &kafka.Hash{},
+			BatchTimeout:           10 * time.Millisecond,
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+		}
+		return nil
+	}
+	if topicTemplate, err = checkTemplate("natsSubject", *natsSubject); err != nil {
+		return err
+	}
+	natsConn, err = nats.Connect(*natsURL, nats.Name("recv.sh"), nats.MaxReconnects(-1))
+	return err
+}
+
+func closePublisher() {
+	if kafkaWriter != nil {
+		if err := kafkaWriter.Close(); err != nil {
+			log("Close kafka writer error: %s\n", err.Error())
+		}
+	}
+	if natsConn != nil {
+		natsConn.Close()
+	}
+}
+
+// linePublisher sends every line written by a connection as a message, with
+// the sender in its headers.
+type linePublisher struct {
+	topic   string
+	key     []byte
+	headers map[string]string
+	batch   []kafka.Message
+	err     error
+}
+
+func newPublisher(topic string, info *connInfo, binding *templateBinding) *linePublisher {
+	p := &linePublisher{
+		topic: topic,
+		key:   []byte(info.addr.String()),
+		headers: map[string]string{
+			"peer":  info.addr.String(),
+			"id":    strconv.FormatInt(info.Id, 10),
+			"proto": binding.Proto,
+		},
+	}
+	if binding.CN != "" {
+		p.headers["cn"] = binding.CN
+	}
+	return p
+}
+
+func (p *linePublisher) Write(line []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	data := line
+	if len(data) > 0 && data[len(data)-1] == delimiter {
+		data = data[:len(data)-1]
+	}
+	if natsConn != nil {
+		msg := &nats.Msg{Subject: p.topic, Data: data, Header: nats.Header{}}
+		for name, value := range p.headers {
+			msg.Header.Set(name, value)
+		}
+		if p.err = natsConn.PublishMsg(msg); p.err != nil {
+			return 0, p.err
+		}
+		return len(line), nil
+	}
+	msg := kafka.Message{Topic: p.topic, Key: p.key, Value: append([]byte(nil), data...)}
+	for name, value := range p.headers {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: name, Value: []byte(value)})
+	}
+	p.batch = append(p.batch, msg)
+	if len(p.batch) >= publishBatchSize {
+		if p.err = p.flush(); p.err != nil {
+			return 0, p.err
+		}
+	}
+	return len(line), nil
+}
+
+func (p *linePublisher) flush() error {
+	if len(p.batch) == 0 {
+		return nil
+	}
+	err := kafkaWriter.WriteMessages(context.Background(), p.batch...)
+	p.batch = p.batch[:0]
+	if err != nil {
+		return fmt.Errorf("publish to %s: %w", p.topic, err)
+	}
+	return nil
+}
+
+// commit waits until the broker has got the remaining lines of the
+// connection.
+func (p *linePublisher) commit() error {
+	if p.err != nil {
+		return p.err
+	}
+	if natsConn != nil {
+		if err := natsConn.FlushTimeout(10 * time.Second); err != nil {
+			return fmt.Errorf("publish to %s: %w", p.topic, err)
+		}
+		return nil
+	}
+	return p.flush()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/quic-go/quic-go"
+	"net"
+	"sync/atomic"
+)
+
+// the ALPN protocol clients of --quic have to offer
+const quicProtocol = "recv.sh"
+
+var quicListeners []*quic.Listener
+
+func listenQuic(udpConn net.PacketConn, tlsConfig *tls.Config) (*quic.Listener, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{quicProtocol}
+	// unlike one of quic.ListenAddr, closing a listener of a transport keeps
+	// the established connections, so that they are drained on shutdown
+	transport := &quic.Transport{Conn: udpConn}
+	l, err := transport.Listen(tlsConfig, &quic.Config{})
+	if err != nil {
+		return nil, err
+	}
+	quicListeners = append(quicListeners, l)
+	return l, nil
+}
+
+func serveQuic(l *quic.Listener) {
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			if atomic.LoadInt32(&shuttingDown) == 1 || listenerRemoved(l) {
+				return
+			}
+			exit(err)
+		}
+		if !checkAllowed(conn.RemoteAddr()) {
+			log("Reject connection from %s, not allowed\n", conn.RemoteAddr())
+			conn.CloseWithError(0, "not allowed")
+			continue
+		}
+		if !checkDistinctIp(conn.RemoteAddr()) {
+			log("Reject connection from %s\n", conn.RemoteAddr())
+			conn.CloseWithError(0, "not allowed")
+			continue
+		}
+		go serveQuicConn(conn)
+	}
+}
+
+// serveQuicConn handles every stream the client opens like a tcp connection.
+func serveQuicConn(conn quic.Connection) {
+	var cn string
+	if certs := conn.ConnectionState().TLS.PeerCertificates; len(certs) > 0 {
+		cn = certs[0].Subject.CommonName
+	}
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			// closed by the client or idle
+			return
+		}
+		// before takeCount, which lets main wait for the last stream of --count
+		inflight.Add(1)
+		if atomic.LoadInt32(&shuttingDown) == 1 || !takeCount() {
+			conn.CloseWithError(0, "shutting down")
+			inflight.Done()
+			return
+		}
+		t := currentFileTemplate()
+		connId := atomic.AddInt64(&id, 1)
+		info := newConnInfo(conn.RemoteAddr(), connId)
+		info.local = conn.LocalAddr()
+		info.CN = cn
+		info.quic = true
+
+		var outputFile *outputFile
+		if !*firstLineKey && !*header {
+			if outputFile = getOutputFile(t, info, ""); outputFile == nil {
+				stream.CancelRead(0)
+				stream.Close()
+				inflight.Done()
+				continue
+			}
+		}
+		queued, ok := queueConnSlot()
+		if !ok {
+			logQueueFull(conn.RemoteAddr())
+			stream.CancelRead(0)
+			stream.Close()
+			inflight.Done()
+			continue
+		}
+		go func() {
+			if !waitConnSlot(queued) {
+				log("Reject stream from %s, waited %s\n", conn.RemoteAddr(), *queueTimeout)
+				stream.CancelRead(0)
+				stream.Close()
+				inflight.Done()
+				return
+			}
+			handleMutex.Lock()
+			defer func() {
+				handleMutex.Unlock()
+				stream.Close()
+				releaseConnSlot()
+				inflight.Done()
+			}()
+			handleConn(stream, t, info, outputFile)
+		}()
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/time/rate"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// per-IP buckets not used for this long are dropped
+const ipLimiterIdle = time.Minute
+
+var (
+	// shared by all connections for --max-rate
+	globalLimiter *rate.Limiter
+
+	errConnTooLarge = errors.New("connection exceeds --max-bytes-per-conn")
+)
+
+// rateReader throttles reading from a connection with a token bucket.
+type rateReader struct {
+	reader    io.Reader
+	limiter   *rate.Limiter
+	info      *connInfo
+	touch     *int64
+	throttled bool
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	if burst := r.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if r.touch != nil {
+			atomic.StoreInt64(r.touch, time.Now().UnixNano())
+		}
+		if delay := r.limiter.ReserveN(time.Now(), n).Delay(); delay > 0 {
+			if !r.throttled {
+				r.throttled = true
+				r.info.Throttled = true
+				log("Connection %s is throttled\n", r.info.addr)
+			}
+			time.Sleep(delay)
+		}
+	}
+	return n, err
+}
+
+func newRateLimiter(bytesPerSec int) *rate.Limiter {
+	burst := bytesPerSec
+	if burst > 64*1024 {
+		burst = 64 * 1024
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+type ipLimiter struct {
+	lastUsed int64 // first for 64-bit atomic alignment
+	limiter  *rate.Limiter
+}
+
+var (
+	ipLimitersMutex sync.Mutex
+	ipLimiters      = make(map[string]*ipLimiter)
+)
+
+func newPerIpRateReader(reader io.Reader, info *connInfo) io.Reader {
+	ipLimitersMutex.Lock()
+	l, ok := ipLimiters[info.Ip]
+	if !ok {
+		l = &ipLimiter{limiter: newRateLimiter(int(*perIpRate))}
+		ipLimiters[info.Ip] = l
+	}
+	atomic.StoreInt64(&l.lastUsed, time.Now().UnixNano())
+	ipLimitersMutex.Unlock()
+	return &rateReader{reader: reader, limiter: l.limiter, info: info, touch: &l.lastUsed}
+}
+
+func evictIpLimiters() {
+	for range time.Tick(ipLimiterIdle) {
+		ipLimitersMutex.Lock()
+		for ip, l := range ipLimiters {
+			if time.Since(time.Unix(0, atomic.LoadInt64(&l.lastUsed))) > ipLimiterIdle {
+				delete(ipLimiters, ip)
+			}
+		}
+		ipLimitersMutex.Unlock()
+	}
+}
+
+// sizeLimitReader ends a connection with an error once it sends more than
+// --max-bytes-per-conn, the bytes up to the limit are still read.
+type sizeLimitReader struct {
+	reader io.Reader
+	left   int64
+	info   *connInfo
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		// only fail when there is more data indeed
+		var b [1]byte
+		n, err := r.reader.Read(b[:])
+		if n == 0 {
+			return 0, err
+		}
+		r.info.Truncated = true
+		return 0, errConnTooLarge
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.reader.Read(p)
+	r.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"os"
+	"sync"
+)
+
+var (
+	schema      *jsonschema.Schema
+	rejectFile  *os.File
+	rejectMutex sync.Mutex
+)
+
+func validateLine(line []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(bytes.TrimSuffix(line, []byte{delimiter})))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	return schema.Validate(v)
+}
+
+func openRejectFile(fileName string) (*os.File, error) {
+	return os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// rejectLine writes a line refused by validation to --reject-file, or drops
+// it when no reject file is given.
+func rejectLine(line []byte) {
+	if rejectFile == nil {
+		return
+	}
+	rejectMutex.Lock()
+	defer rejectMutex.Unlock()
+	if _, err := rejectFile.Write(line); err != nil {
+		log("Write reject file error: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenConfig applies --reuseport, --recv-buffer and --keepalive to the
+// sockets listened on. Inherited ones of --fd are taken as they are.
+func listenConfig() *net.ListenConfig {
+	return &net.ListenConfig{
+		KeepAlive: *keepAlive,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if e := c.Control(func(fd uintptr) { err = setSocketOptions(network, fd) }); e != nil {
+				return e
+			}
+			return err
+		},
+	}
+}
+
+// ipNetwork restricts tcp or udp to the family of --ip-version, dual leaves
+// it to the host of the address.
+func ipNetwork(network string) string {
+	if *ipVersion == "dual" {
+		return network
+	}
+	return network + *ipVersion
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+func setSocketOptions(network string, fd uintptr) error {
+	if *reusePort || *recvBuffer > 0 {
+		return errors.New("--reuseport and --recv-buffer are not supported on this platform")
+	}
+	return nil
+}
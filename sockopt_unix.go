@@ -0,0 +1,34 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"runtime"
+	"strings"
+)
+
+func setSocketOptions(network string, fd uintptr) error {
+	if *reusePort && !strings.HasPrefix(network, "unix") {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return fmt.Errorf("set SO_REUSEPORT: %w", err)
+		}
+	}
+	if *recvBuffer > 0 {
+		size := int(*recvBuffer)
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, size); err != nil {
+			return fmt.Errorf("set SO_RCVBUF: %w", err)
+		}
+		got, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		if runtime.GOOS == "linux" {
+			// linux reports twice the size for its bookkeeping, and caps it
+			// silently
+			got /= 2
+		}
+		if err == nil && got < size {
+			warn("Warning: the receive buffer is limited to %d bytes, raise net.core.rmem_max\n", got)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connProgress counts the bytes read from a connection so far, as received
+// before decompression, for --stats.
+type connProgress struct {
+	info     *connInfo
+	reader   io.Reader
+	received int64
+	// at the previous report, only touched by reportProgress
+	reported int64
+}
+
+func (p *connProgress) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	atomic.AddInt64(&p.received, int64(n))
+	return n, err
+}
+
+// connStats is a connection still open in /stats and the summary of
+// --stats-file.
+type connStats struct {
+	Id       int64   `json:"id"`
+	Peer     string  `json:"peer"`
+	File     string  `json:"file,omitempty"`
+	Received int64   `json:"received"`
+	Duration float64 `json:"duration"`
+	Rate     float64 `json:"rate"`
+}
+
+// peerStats sums up the finished connections of a sender for --stats-file.
+type peerStats struct {
+	Ip          string `json:"ip"`
+	Connections int64  `json:"connections"`
+	Failed      int64  `json:"failed"`
+	Bytes       int64  `json:"bytes"`
+	Received    int64  `json:"received"`
+}
+
+var (
+	statsStart    = time.Now()
+	progressMutex sync.Mutex
+	progresses    = make(map[*connInfo]*connProgress)
+	peerSummary   = make(map[string]*peerStats)
+)
+
+// trackProgress counts the bytes read from reader until finishProgress.
+func trackProgress(info *connInfo, reader io.Reader) io.Reader {
+	p := &connProgress{info: info, reader: reader}
+	progressMutex.Lock()
+	progresses[info] = p
+	progressMutex.Unlock()
+	return p
+}
+
+// finishProgress adds the connection to the summary of its sender.
+func finishProgress(info *connInfo) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	p, ok := progresses[info]
+	if !ok {
+		return
+	}
+	delete(progresses, info)
+	peer := peerSummary[info.Ip]
+	if peer == nil {
+		peer = &peerStats{Ip: info.Ip}
+		peerSummary[info.Ip] = peer
+	}
+	peer.Connections++
+	if info.Error != "" {
+		peer.Failed++
+	}
+	peer.Bytes += info.Bytes
+	peer.Received += atomic.LoadInt64(&p.received)
+}
+
+func (p *connProgress) stats() connStats {
+	s := connStats{
+		Id:       p.info.Id,
+		Peer:     p.info.addr.String(),
+		Received: atomic.LoadInt64(&p.received),
+		Duration: time.Since(p.info.start).Seconds(),
+	}
+	if p.info.output != nil {
+		s.File = p.info.output.label()
+	}
+	if s.Duration > 0 {
+		s.Rate = float64(s.Received) / s.Duration
+	}
+	return s
+}
+
+// openProgresses lists the connections being read in the order they were
+// accepted.
+func openProgresses() []*connProgress {
+	progressMutex.Lock()
+	list := make([]*connProgress, 0, len(progresses))
+	for _, p := range progresses {
+		list = append(list, p)
+	}
+	progressMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].info.Id < list[j].info.Id })
+	return list
+}
+
+func openConnStats() []connStats {
+	list := openProgresses()
+	stats := make([]connStats, len(list))
+	for i, p := range list {
+		stats[i] = p.stats()
+	}
+	return stats
+}
+
+// reportProgress logs every interval how much each open connection received
+// in total and since the last report, a connection which received nothing
+// meanwhile is reported as stalled.
+func reportProgress(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, p := range openProgresses() {
+			s := p.stats()
+			recent := s.Received - p.reported
+			p.reported = s.Received
+			state := ""
+			if recent == 0 {
+				state = ", stalled"
+			}
+			if *logFormat == "json" {
+				writeEventLine(logEvent{
+					Time:  time.Now().Format(time.RFC3339Nano),
+					Level: "info",
+					Msg:   "progress",
+					connEvent: &connEvent{
+						Event:    "progress",
+						Id:       s.Id,
+						Peer:     s.Peer,
+						Ip:       p.info.Ip,
+						Port:     p.info.Port,
+						Seq:      p.info.Seq,
+						File:     s.File,
+						Bytes:    s.Received,
+						Duration: s.Duration,
+					},
+				})
+				continue
+			}
+			warn("Connection %s received %d bytes in %s, %d bytes/s%s\n", s.Peer, s.Received,
+				time.Duration(s.Duration*float64(time.Second)).Round(time.Second), int64(float64(recent)/interval.Seconds()), state)
+		}
+	}
+}
+
+// writeStats serves the open connections and the refusals of --queue-timeout
+// as JSON on /stats of --metrics-addr.
+func writeStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		QueueTimeouts int64       `json:"queue_timeouts"`
+		Open          []connStats `json:"open"`
+	}{atomic.LoadInt64(&queueTimeouts), openConnStats()})
+}
+
+// writeStatsFile writes the summary of the connections handled and still open
+// to --stats-file on exit.
+func writeStatsFile() {
+	if *statsFile == "" {
+		return
+	}
+	end := time.Now()
+	summary := struct {
+		Start       string      `json:"start"`
+		End         string      `json:"end"`
+		Duration    float64     `json:"duration"`
+		Connections int64       `json:"connections"`
+		Bytes       int64       `json:"bytes"`
+		Lines       int64       `json:"lines"`
+		Refused     int64       `json:"refused"`
+		RejectedIps int64       `json:"rejected_ips"`
+		Timeouts    int64       `json:"queue_timeouts"`
+		Rate        float64     `json:"rate"`
+		Peers       []peerStats `json:"peers"`
+		Open        []connStats `json:"open"`
+	}{
+		Start:       statsStart.Format(time.RFC3339Nano),
+		End:         end.Format(time.RFC3339Nano),
+		Duration:    end.Sub(statsStart).Seconds(),
+		Connections: atomic.LoadInt64(&totalConns),
+		Bytes:       atomic.LoadInt64(&totalBytes),
+		Lines:       atomic.LoadInt64(&totalLines),
+		Refused:     atomic.LoadInt64(&refused),
+		RejectedIps: atomic.LoadInt64(&rejectedIps),
+		Timeouts:    atomic.LoadInt64(&queueTimeouts),
+		Peers:       []peerStats{},
+		Open:        openConnStats(),
+	}
+	if summary.Duration > 0 {
+		summary.Rate = float64(summary.Bytes) / summary.Duration
+	}
+	progressMutex.Lock()
+	for _, peer := range peerSummary {
+		summary.Peers = append(summary.Peers, *peer)
+	}
+	progressMutex.Unlock()
+	sort.Slice(summary.Peers, func(i, j int) bool { return summary.Peers[i].Ip < summary.Peers[j].Ip })
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err == nil {
+		err = os.WriteFile(*statsFile, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		warn("Write %s error: %s\n", *statsFile, err.Error())
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// keep every packet below the common ethernet MTU
+const statsdMaxPacket = 1432
+
+type statsdClient struct {
+	mutex  sync.Mutex
+	conn   net.Conn
+	prefix string
+	buf    []byte
+}
+
+func newStatsdClient(addr, prefix string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &statsdClient{
+		conn:   conn,
+		prefix: prefix,
+		buf:    make([]byte, 0, statsdMaxPacket),
+	}
+	go func() {
+		for range time.Tick(time.Second) {
+			c.Flush()
+		}
+	}()
+	return c, nil
+}
+
+func (c *statsdClient) Count(name string, value int64) {
+	c.send(name, value, "c")
+}
+
+func (c *statsdClient) Timing(name string, d time.Duration) {
+	c.send(name, d.Milliseconds(), "ms")
+}
+
+func (c *statsdClient) send(name string, value int64, kind string) {
+	if c == nil {
+		return
+	}
+	metric := fmt.Sprintf("%s%s:%d|%s", c.prefix, name, value, kind)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.buf) > 0 && len(c.buf)+1+len(metric) > statsdMaxPacket {
+		c.flush()
+	}
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, metric...)
+}
+
+func (c *statsdClient) Flush() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.flush()
+}
+
+func (c *statsdClient) flush() {
+	if len(c.buf) == 0 {
+		return
+	}
+	if _, err := c.conn.Write(c.buf); err != nil {
+		log("Statsd error: %s\n", err.Error())
+	}
+	c.buf = c.buf[:0]
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	syslogFacilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+	syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+)
+
+// syslogMessage holds the fields of a message of --syslog for the output file
+// template.
+type syslogMessage struct {
+	facility string
+	severity string
+	host     string
+	app      string
+	time     time.Time
+}
+
+// parseSyslog reads the header of an RFC 5424 or RFC 3164 message, the host
+// is the sender ip and the time when it was received if the message has
+// none.
+func parseSyslog(line []byte, info *connInfo) *syslogMessage {
+	// a message without priority is user.notice, see RFC 3164 4.3.3
+	m := &syslogMessage{facility: "user", severity: "notice", host: info.Ip, app: "-", time: time.Now()}
+	text := strings.TrimRight(string(line), "\r\n")
+	if !strings.HasPrefix(text, "<") {
+		return m
+	}
+	end := strings.IndexByte(text, '>')
+	pri, err := strconv.Atoi(text[1:max(end, 1)])
+	if end < 2 || end > 4 || err != nil || pri > 191 {
+		return m
+	}
+	m.facility, m.severity = syslogFacilities[pri/8], syslogSeverities[pri%8]
+	text = text[end+1:]
+
+	var host, app string
+	if rest, ok := strings.CutPrefix(text, "1 "); ok {
+		// VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID ...
+		fields := strings.SplitN(rest, " ", 4)
+		if len(fields) >= 3 {
+			if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+				m.time = t
+			}
+			host, app = fields[1], fields[2]
+		}
+	} else if len(text) >= len(time.Stamp) {
+		// Mmm dd hh:mm:ss HOSTNAME TAG[PID]: ...
+		if t, err := time.ParseInLocation(time.Stamp, text[:len(time.Stamp)], time.Local); err == nil {
+			now := time.Now()
+			m.time = t.AddDate(now.Year(), 0, 0)
+			if m.time.After(now.Add(24 * time.Hour)) {
+				// sent on the last day of the previous year
+				m.time = m.time.AddDate(-1, 0, 0)
+			}
+			fields := strings.SplitN(strings.TrimLeft(text[len(time.Stamp):], " "), " ", 3)
+			if len(fields) >= 2 && !strings.ContainsAny(fields[0], ":[") {
+				host, fields = fields[0], fields[1:]
+			}
+			app, _, _ = strings.Cut(fields[0], "[")
+			app = strings.TrimSuffix(app, ":")
+		}
+	}
+	if host != "" && host != "-" {
+		m.host = sanitizeKey(host)
+	}
+	if app != "" && app != "-" {
+		m.app = sanitizeKey(app)
+	}
+	return m
+}
+
+// syslogSplit splits octet counted messages of RFC 6587, i.e. "5 <13>a",
+// and newline delimited ones like s does.
+func syslogSplit(s *lineSplitter) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if s.discarding || len(data) == 0 || data[0] < '1' || data[0] > '9' {
+			return s.split(data, atEOF)
+		}
+		space := bytes.IndexByte(data, ' ')
+		if space < 0 && len(data) < 10 && !atEOF {
+			return 0, nil, nil
+		}
+		n, err := strconv.Atoi(string(data[:max(space, 0)]))
+		if space < 0 || err != nil {
+			return s.split(data, atEOF)
+		}
+		if n > s.max {
+			return 0, nil, bufio.ErrTooLong
+		}
+		end := space + 1 + n
+		if len(data) < end {
+			if atEOF {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			return 0, nil, nil
+		}
+		return end, data[space+1 : end], nil
+	}
+}
+
+// syslogRouter stands in for the output file of a connection with --syslog,
+// every message is written to the file of its own fields.
+type syslogRouter struct {
+	t     *template.Template
+	files map[*outputFile]bool
+}
+
+// route returns the output file of the message, nil when it should be
+// dropped.
+func (r *syslogRouter) route(info *connInfo, line []byte) *outputFile {
+	info.syslog = parseSyslog(line, info)
+	defer func() { info.syslog = nil }()
+	file := getOutputFile(r.t, info, "")
+	if file != nil {
+		r.files[file] = true
+	}
+	return file
+}
+
+// flush flushes the files the messages of the connection went to.
+func (r *syslogRouter) flush() error {
+	var err error
+	for file := range r.files {
+		if e := file.Flush(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
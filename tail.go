@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const tailPollInterval = 250 * time.Millisecond
+
+var tailSlots chan struct{}
+
+func serveTail(addr string, maxTailers int) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	tailSlots = make(chan struct{}, maxTailers)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tail/", handleTail)
+	go func() {
+		err := http.Serve(listener, mux)
+		log("Tail server closed: %s\n", err.Error())
+	}()
+	return nil
+}
+
+func lookupOutputFile(name string) *outputFile {
+	fileMapMutex.Lock()
+	defer fileMapMutex.Unlock()
+	return fileMap[name]
+}
+
+// handleTail streams data appended to the capture file named in the request
+// path, like `tail -f`. Only files opened by this process can be tailed, and
+// the logical name is followed when the file is switched underneath.
+func handleTail(w http.ResponseWriter, r *http.Request) {
+	select {
+	case tailSlots <- struct{}{}:
+		defer func() { <-tailSlots }()
+	default:
+		http.Error(w, "too many tailers", http.StatusServiceUnavailable)
+		return
+	}
+
+	output := lookupOutputFile(strings.TrimPrefix(r.URL.Path, "/tail/"))
+	if output == nil {
+		http.NotFound(w, r)
+		return
+	}
+	path := output.currentPath()
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		f.Close()
+	}()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	log("Tail %s from %s\n", path, r.RemoteAddr)
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	for {
+		n, err := io.Copy(w, f)
+		offset += n
+		if err != nil {
+			return
+		}
+		if n > 0 && flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		if p := output.currentPath(); p != path {
+			// the data left in the old file has been copied above
+			next, err := os.Open(p)
+			if err != nil {
+				continue
+			}
+			f.Close()
+			f, path, offset = next, p, 0
+			log("Tail follows %s\n", path)
+		} else if info, err := f.Stat(); err == nil && info.Size() < offset {
+			// truncated in place
+			offset, _ = f.Seek(0, io.SeekStart)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	tarMutex      sync.Mutex
+	tarWriter     *tar.Writer
+	tarCompressor encoder
+	tarOutput     *os.File
+)
+
+// tarCompression returns how --tar-output is compressed, by --compress-output
+// or else gzip for a .tar.gz or .tgz name.
+func tarCompression() string {
+	if *compressOutput == "none" && (strings.HasSuffix(*tarOutputName, ".tar.gz") || strings.HasSuffix(*tarOutputName, ".tgz")) {
+		return "gzip"
+	}
+	return *compressOutput
+}
+
+func openTarOutput(fileName string) error {
+	tarOutput = os.Stdout
+	if fileName != "-" {
+		f, err := os.Create(fileName)
+		if err != nil {
+			return err
+		}
+		tarOutput = f
+	}
+	// a compressed archive is flushed after every entry
+	var err error
+	if tarCompressor, err = newCompressor(tarOutput, tarCompression()); err != nil {
+		return err
+	}
+	if tarCompressor != nil {
+		tarWriter = tar.NewWriter(tarCompressor)
+	} else {
+		tarWriter = tar.NewWriter(tarOutput)
+	}
+	return nil
+}
+
+func closeTarOutput() {
+	if tarWriter == nil {
+		return
+	}
+	tarMutex.Lock()
+	defer tarMutex.Unlock()
+	err := tarWriter.Close()
+	if err == nil && tarCompressor != nil {
+		err = tarCompressor.Close()
+	}
+	if err != nil {
+		log("Close tar output error: %s\n", err.Error())
+	}
+	tarOutput.Close()
+}
+
+// tarEntry collects the data of one connection, since the size has to be
+// known before the entry can be written to the archive. Data beyond
+// --tar-spill is kept in a temporary file instead of memory.
+type tarEntry struct {
+	name  string
+	size  int64
+	buf   bytes.Buffer
+	spill *os.File
+}
+
+func (e *tarEntry) Write(p []byte) (int, error) {
+	if e.spill == nil && e.buf.Len()+len(p) > int(*tarSpill) {
+		f, err := os.CreateTemp("", "recv-tar-")
+		if err != nil {
+			return 0, err
+		}
+		os.Remove(f.Name())
+		e.spill = f
+		if _, err = e.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if e.spill != nil {
+		n, err = e.spill.Write(p)
+	} else {
+		n, err = e.buf.Write(p)
+	}
+	e.size += int64(n)
+	return n, err
+}
+
+// commit appends the collected data to the archive as a single entry.
+func (e *tarEntry) commit() error {
+	var content io.Reader = &e.buf
+	if e.spill != nil {
+		defer e.spill.Close()
+		if _, err := e.spill.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		content = e.spill
+	}
+
+	tarMutex.Lock()
+	defer tarMutex.Unlock()
+	err := tarWriter.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     e.name,
+		Size:     e.size,
+		Mode:     0644,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(tarWriter, content, e.size); err != nil {
+		return err
+	}
+	if err = tarWriter.Flush(); err != nil || tarCompressor == nil {
+		return err
+	}
+	return tarCompressor.Flush()
+}
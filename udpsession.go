@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// datagrams queued per session before reading from the socket blocks
+const udpSessionQueue = 1024
+
+var (
+	udpSessions      = make(map[string]*udpSession)
+	udpSessionsMutex sync.Mutex
+)
+
+type datagram struct {
+	buf *[]byte
+	n   int
+}
+
+// udpSession reads the datagrams of one sender as a single stream, it ends
+// once the sender was idle for --udp-idle-timeout.
+type udpSession struct {
+	last int64 // first for 64-bit atomic alignment
+
+	mutex   sync.Mutex
+	key     string
+	queue   chan datagram
+	current datagram
+	offset  int
+}
+
+// dispatchDatagram queues the datagram to the session of its sender, starting
+// one if needed. It reports false once --count connections have been taken.
+func dispatchDatagram(t *template.Template, l net.PacketConn, addr net.Addr, buf *[]byte, n int) bool {
+	key := addr.String()
+	udpSessionsMutex.Lock()
+	s := udpSessions[key]
+	if s == nil {
+		if !takeCount() {
+			udpSessionsMutex.Unlock()
+			return false
+		}
+		info := newConnInfo(addr, atomic.AddInt64(&id, 1))
+		info.local = l.LocalAddr()
+		var outputFile *outputFile
+		if !*firstLineKey {
+			if outputFile = getOutputFile(t, info, ""); outputFile == nil {
+				udpSessionsMutex.Unlock()
+				udpBufferPool.Put(buf, n)
+				return true
+			}
+		}
+		s = &udpSession{key: key, queue: make(chan datagram, udpSessionQueue)}
+		udpSessions[key] = s
+		time.AfterFunc(*udpIdleTimeout, s.expire)
+
+		acquireConnSlot()
+		inflight.Add(1)
+		go func() {
+			handleMutex.Lock()
+			defer func() {
+				handleMutex.Unlock()
+				s.drain()
+				releaseConnSlot()
+				inflight.Done()
+			}()
+			handleUdp(s, t, l, info, outputFile)
+		}()
+	}
+	s.mutex.Lock()
+	udpSessionsMutex.Unlock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+	s.queue <- datagram{buf, n}
+	return true
+}
+
+// expire ends the session once it was idle for long enough, or checks again
+// when that will be the case.
+func (s *udpSession) expire() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.last)))
+	if idle < *udpIdleTimeout {
+		time.AfterFunc(*udpIdleTimeout-idle, s.expire)
+		return
+	}
+	udpSessionsMutex.Lock()
+	delete(udpSessions, s.key)
+	udpSessionsMutex.Unlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	close(s.queue)
+}
+
+func (s *udpSession) Read(p []byte) (int, error) {
+	for s.current.buf == nil || s.offset == s.current.n {
+		if s.current.buf != nil {
+			udpBufferPool.Put(s.current.buf, s.current.n)
+		}
+		d, ok := <-s.queue
+		if !ok {
+			s.current = datagram{}
+			return 0, io.EOF
+		}
+		s.current, s.offset = d, 0
+	}
+	n := copy(p, (*s.current.buf)[s.offset:s.current.n])
+	s.offset += n
+	return n, nil
+}
+
+// drain returns the buffers left when the session is not read to the end.
+func (s *udpSession) drain() {
+	if s.current.buf != nil {
+		udpBufferPool.Put(s.current.buf, s.current.n)
+		s.current = datagram{}
+	}
+	for d := range s.queue {
+		udpBufferPool.Put(d.buf, d.n)
+	}
+}
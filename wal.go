@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// walEntry is the write-ahead log of a single connection, removed once its
+// data is committed to the output file.
+type walEntry struct {
+	file *os.File
+	path string
+}
+
+// captureWal reads the connection into a new log under --wal, syncing it every
+// --wal-sync, and returns a reader over the logged data. Data the log could
+// not take is read from the connection directly.
+func captureWal(reader io.Reader, info *connInfo, output *outputFile) (*walEntry, io.Reader, error) {
+	path := filepath.Join(*walDir, fmt.Sprintf("%d-%d.wal", info.start.UnixNano(), info.Id))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, reader, err
+	}
+	entry := &walEntry{file: file, path: path}
+	header := fmt.Sprintf("%s %q %d %q\n", info.addr.Network(), info.addr.String(), info.Id, output.walName())
+	if _, err = file.WriteString(header); err == nil {
+		err = syncDir(*walDir)
+	}
+	if err != nil {
+		entry.remove()
+		return nil, reader, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(*walSync)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				file.Sync()
+			case <-done:
+				return
+			}
+		}
+	}()
+	_, err = io.Copy(file, reader)
+	close(done)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		log("Write ahead log %s error: %s\n", path, err.Error())
+	}
+	if _, err = file.Seek(int64(len(header)), io.SeekStart); err != nil {
+		entry.remove()
+		return nil, reader, err
+	}
+	return entry, io.MultiReader(file, reader), nil
+}
+
+// commit removes the log after the data reached the output file on disk.
+func (e *walEntry) commit(output *outputFile) {
+	if e == nil {
+		return
+	}
+	var err error
+	if output.throttle != nil {
+		err = output.throttle.Flush()
+	}
+	if err == nil {
+		err = output.Sync()
+	}
+	if err != nil {
+		log("Keep write ahead log %s, sync output error: %s\n", e.path, err.Error())
+		e.file.Close()
+		return
+	}
+	e.remove()
+}
+
+func (e *walEntry) remove() {
+	e.file.Close()
+	if err := os.Remove(e.path); err != nil {
+		log("Remove write ahead log %s error: %s\n", e.path, err.Error())
+	}
+}
+
+// recoverWal replays the logs left under --wal by a crash, in the order the
+// connections were accepted.
+func recoverWal() error {
+	paths, err := filepath.Glob(filepath.Join(*walDir, "*.wal"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		reader := bufio.NewReader(file)
+		var network, address, name string
+		var id int64
+		if _, err = fmt.Fscanf(reader, "%s %q %d %q\n", &network, &address, &id, &name); err != nil {
+			file.Close()
+			warn("Warning: skip unreadable write ahead log %s: %s\n", path, err.Error())
+			continue
+		}
+		var addr net.Addr
+		switch network {
+		case "unix", "unixgram":
+			addr = &net.UnixAddr{Name: address, Net: network}
+		case "udp":
+			addr, err = net.ResolveUDPAddr(network, address)
+		default:
+			addr, err = net.ResolveTCPAddr(network, address)
+		}
+		if err != nil {
+			file.Close()
+			warn("Warning: skip unreadable write ahead log %s: %s\n", path, err.Error())
+			continue
+		}
+		log("Recover write ahead log %s\n", path)
+		info := newConnInfo(addr, id)
+		info.wal = &walEntry{file: file, path: path}
+		handleRequest(reader, info, outputFileByName(name))
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// number of messages queued per client before new ones are dropped
+const wsQueueSize = 256
+
+type wsClient struct {
+	conn  *websocket.Conn
+	queue chan wsMessage
+}
+
+type wsMessage struct {
+	messageType int
+	data        []byte
+}
+
+type wsHub struct {
+	mutex    sync.Mutex
+	clients  map[*wsClient]struct{}
+	upgrader websocket.Upgrader
+	listener net.Listener
+}
+
+func newWsHub(addr string) (*wsHub, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	h := &wsHub{
+		clients:  make(map[*wsClient]struct{}),
+		listener: listener,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	go func() {
+		err := http.Serve(listener, h)
+		log("WebSocket server closed: %s\n", err.Error())
+	}()
+	return h, nil
+}
+
+func (h *wsHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log("WebSocket upgrade error: %s\n", err.Error())
+		return
+	}
+	c := &wsClient{
+		conn:  conn,
+		queue: make(chan wsMessage, wsQueueSize),
+	}
+	h.mutex.Lock()
+	h.clients[c] = struct{}{}
+	h.mutex.Unlock()
+	log("WebSocket client %s connected\n", conn.RemoteAddr())
+
+	go func() {
+		for m := range c.queue {
+			if err := conn.WriteMessage(m.messageType, m.data); err != nil {
+				break
+			}
+		}
+		conn.Close()
+	}()
+	// drain control frames until the client goes away
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			break
+		}
+	}
+	h.mutex.Lock()
+	delete(h.clients, c)
+	h.mutex.Unlock()
+	close(c.queue)
+	log("WebSocket client %s disconnected\n", conn.RemoteAddr())
+}
+
+func (h *wsHub) Broadcast(messageType int, data []byte) {
+	if h == nil {
+		return
+	}
+	m := wsMessage{messageType: messageType, data: append([]byte(nil), data...)}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for c := range h.clients {
+		select {
+		case c.queue <- m:
+		default:
+			log("WebSocket client %s is too slow, drop message\n", c.conn.RemoteAddr())
+		}
+	}
+}
+
+// Write broadcasts the chunk as a binary message, so the hub can sit behind an
+// io.MultiWriter in chunk mode.
+func (h *wsHub) Write(p []byte) (int, error) {
+	h.Broadcast(websocket.BinaryMessage, p)
+	return len(p), nil
+}
+
+func (h *wsHub) Close() {
+	if h == nil {
+		return
+	}
+	h.listener.Close()
+}
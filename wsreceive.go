@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"io"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+var wsReceiver = websocket.Upgrader{
+	// senders run in browsers of any origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// handleWsClient handles the messages of a websocket client of --ws like the
+// data of a tcp connection.
+func handleWsClient(t *template.Template, w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "websocket expected", http.StatusBadRequest)
+		return
+	}
+	info := acceptRequest(w, r)
+	if info == nil {
+		return
+	}
+	defer releaseConnSlot()
+	conn, err := wsReceiver.Upgrade(w, r, nil)
+	if err != nil {
+		log("WebSocket upgrade of %s error: %s\n", info.addr, err.Error())
+		return
+	}
+	defer conn.Close()
+	// answer the close of the client only after the --ack
+	conn.SetCloseHandler(func(int, string) error { return nil })
+	handleMutex.Lock()
+	defer handleMutex.Unlock()
+
+	var outputFile *outputFile
+	var reader io.Reader = &wsReader{conn: conn}
+	if *firstLineKey {
+		reader, outputFile = routeByFirstLine(reader, t, info)
+	} else {
+		outputFile = getOutputFile(t, info, "")
+	}
+	if outputFile == nil {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "no output"), time.Now().Add(time.Second))
+		return
+	}
+	handleRequest(reader, info, outputFile)
+	if reply := ackReply(info); reply != nil {
+		if err := conn.WriteMessage(websocket.TextMessage, reply); err != nil {
+			log("Write ack to %s error: %s\n", info.addr, err.Error())
+		}
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+// wsReader reads the messages of a client as one stream, with
+// --ws-message-lines every message ends with the delimiter.
+type wsReader struct {
+	conn    *websocket.Conn
+	message io.Reader
+	size    int
+	last    byte
+	ended   bool
+}
+
+func (r *wsReader) Read(p []byte) (int, error) {
+	for {
+		if r.ended {
+			r.ended = false
+			p[0] = delimiter
+			return 1, nil
+		}
+		if r.message == nil {
+			if *timeout > 0 {
+				r.conn.SetReadDeadline(time.Now().Add(*timeout))
+			}
+			_, message, err := r.conn.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			r.message, r.size = message, 0
+		}
+		n, err := r.message.Read(p)
+		if n > 0 {
+			r.size += n
+			r.last = p[n-1]
+		}
+		if err == io.EOF {
+			r.message = nil
+			// an empty message is an empty line
+			r.ended = *wsMessageLines && (r.size == 0 || r.last != delimiter)
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}